@@ -0,0 +1,100 @@
+/*
+autocancel.go - Stopping tests of commits that have been superseded
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Watches the remote branch while a commit is tested
+type branchWatch struct {
+	lock sync.Mutex
+
+	// The new tip of the branch, "" until it moves
+	newTip string
+
+	cancel context.CancelFunc
+}
+
+// Stop watching, and return the tip the branch moved to ("" if it didn't)
+func (bw *branchWatch) Stop() string {
+	bw.cancel()
+
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	return bw.newTip
+}
+
+// A context that is cancelled when the remote branch moves past what we fetched
+// The branch is checked straight away, so the context may already be cancelled
+func (c Configuration) WatchBranch(parent context.Context, op Operation) (context.Context, *branchWatch) {
+	ctx, cancel := context.WithCancel(parent)
+	bw := &branchWatch{cancel: cancel}
+
+	tip, err := op.Repo.ResolveRevision(op.Branch)
+	if err != nil {
+		// nothing to compare with, so never cancel
+		return ctx, bw
+	}
+
+	// true if the branch has moved on
+	check := func() bool {
+		remote, err := op.Repo.RemoteTip(op.Branch)
+		if err != nil {
+			if c.Verbose {
+				fmt.Println("  Could not check the remote branch: ", err)
+			}
+			return false
+		}
+		if remote == tip {
+			return false
+		}
+
+		bw.lock.Lock()
+		bw.newTip = remote
+		bw.lock.Unlock()
+		cancel()
+		return true
+	}
+
+	if check() {
+		return ctx, bw
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.ResolvedPollingInterval()) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if check() {
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, bw
+}
+
+// Mark a commit as not worth testing, as the branch has moved on to newTip
+func (c Configuration) SupersedeCommit(op Operation, newTip string) error {
+	fmt.Println("Superseded ", op.Hash, " by ", newTip)
+	c.clearRunning(op)
+	return c.PostStatus(op, KSuperseded, fmt.Sprintf("Superseded by %.12v", newTip), StatusDetail{})
+}
@@ -0,0 +1,115 @@
+/*
+backfill.go - Testing the history of a repository
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+)
+
+type BackfillConfiguration struct {
+	// (optional) How many commits back to go
+	Count int
+
+	// (optional) Only commits after this, a date (2006-01-02) or a revision (e.g. a tag)
+	Since string
+}
+
+// Where a backfill fetches the branch to, rather than moving the branch the ticks compare against
+const kBackfillRef = "refs/cix/backfill"
+
+// Operations for the commits in the history of tip (e.g. the branch) that don't have one of our statuses
+func (c Configuration) BackfillOperations(repo RepositoryConfiguration, r Repository, tip string, bf BackfillConfiguration) ([]Operation, error) {
+	hashes, err := r.ListRecentCommits(tip, bf.Count, bf.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	source := repo.Source()
+	reader, canRead := source.(StatusReader)
+
+	runner, err := c.RunnerFor(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []Operation{}
+	for _, hash := range c.OrderCommits(hashes) {
+		if r.WasSkipped(hash) {
+			if c.Verbose {
+				fmt.Println("  Skipped before ", hash)
+			}
+			continue
+		}
+
+		if canRead {
+			has, err := reader.HasStatus(c.ResolvedName(), hash)
+			if err != nil {
+				return nil, err
+			}
+			if has {
+				if c.Verbose {
+					fmt.Println("  Already tested ", hash)
+				}
+				continue
+			}
+		}
+
+		if c.Verbose {
+			fmt.Println("  Backfill commit ", hash)
+		}
+		ops = append(ops, Operation{
+			Repo:   r,
+			Hash:   hash,
+			Source: source,
+			Branch: repo.Branch,
+			Runner: runner,
+		})
+	}
+	return ops, nil
+}
+
+// Test the history of a repository now
+func (c Configuration) Backfill(sd *Shutdown, name string, bf BackfillConfiguration) error {
+	if bf.Count == 0 && bf.Since == "" {
+		return fmt.Errorf("Backfill needs a count or since")
+	}
+
+	repo, err := c.FindRepository(name)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := c.OpenRepository(c.VarFolder(), repo)
+	if err != nil {
+		return err
+	}
+	tip, err := r.FetchBranchTo(repo.Branch, kBackfillRef)
+	if err != nil {
+		return err
+	}
+
+	ops, err := c.BackfillOperations(repo, r, tip, bf)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Backfilling ", len(ops), " commits of ", repo.Name())
+
+	for _, op := range ops {
+		if sd.Stopping() {
+			return fmt.Errorf("Stopped backfilling %v", repo.Name())
+		}
+		if _, err := c.Execute(sd.Context(), op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+backfill_test.go - Tests of testing the history of a repository
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Commits a backfill fetched but didn't test are still new to the next tick
+func TestBackfillLeavesTheRestForTheTick(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+
+	first := remote.Commit("first")
+	second := remote.Commit("second")
+	third := remote.Commit("third")
+
+	if err := c.Backfill(nil, "owner/repo", BackfillConfiguration{Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if tested := h.Tested(); !reflect.DeepEqual(tested, []string{third}) {
+		t.Fatalf("backfill tested %v, expected %v", tested, []string{third})
+	}
+
+	// the tick tests the tip again too, it doesn't ask the forge what already has a status
+	h.Tick(c)
+	expected := []string{first, second, third}
+	if tested := h.Tested(); !reflect.DeepEqual(tested[1:], expected) {
+		t.Fatalf("tick tested %v, expected %v", tested[1:], expected)
+	}
+}
+
+// Github shows no status for a skipped commit, but it still isn't backfilled, as with the other forges
+func TestBackfillLeavesSkippedCommits(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", `{"github": {"user": "owner", "repository": "repo", "statuspat": "pat"}, "branch": "main", "strategy": "tip"}`)
+	h.Tick(c)
+
+	remote.Commit("first")
+	remote.Commit("second")
+	tip := remote.Commit("third")
+	h.Tick(c)
+	if tested := h.Tested(); !reflect.DeepEqual(tested, []string{tip}) {
+		t.Fatalf("tick tested %v, expected the tip", tested)
+	}
+
+	if err := c.Backfill(nil, "owner/repo", BackfillConfiguration{Count: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if tested := h.Tested(); len(tested) != 1 {
+		t.Errorf("backfill tested %v", tested[1:])
+	}
+}
+
+// A commit with more statuses than github lists at once still has ours
+func TestBackfillPagesThroughStatuses(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+
+	hash := remote.Commit("busy")
+	h.Tick(c)
+
+	others := []string{}
+	for i := 0; i < 150; i++ {
+		others = append(others, fmt.Sprintf("other-%v", i))
+	}
+	h.forge.AddStatuses(hash, others...)
+
+	if err := c.Backfill(nil, "owner/repo", BackfillConfiguration{Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if tested := h.Tested(); len(tested) != 1 {
+		t.Errorf("tested %v, expected the commit once", tested)
+	}
+}
@@ -12,16 +12,13 @@ THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR I
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io"
-	"net/http"
 )
 
 type BitbucketConfiguration struct {
 	Workspace  string
 	Repository string
-	Token      string
+	Token      Secret
 }
 
 var _ RepoSource = &BitbucketConfiguration{}
@@ -42,6 +39,13 @@ func (bc *BitbucketConfiguration) Valid() bool {
 	return bc.Workspace != "" && bc.Repository != ""
 }
 
+type bitbucketStatus struct {
+	Key         string `json:"key"`
+	State       string `json:"state"`
+	Description string `json:"description"`
+	Url         string `json:"url"`
+}
+
 func (bc *BitbucketConfiguration) SetStatus(status CiStatus, comment, description, hash string) error {
 	if bc.Token == "" {
 		return nil
@@ -65,40 +69,62 @@ func (bc *BitbucketConfiguration) SetStatus(status CiStatus, comment, descriptio
 
 	case KSucceeded:
 		st = "SUCCESSFUL"
-	}
 
-	url := fmt.Sprintf("https://api.bitbucket.org/2.0/repositories/%v/%v/commit/%v/statuses/build/%v", bc.Workspace, bc.Repository, hash, optionalKey)
+	case KSkipped, KSuperseded:
+		// the nearest bitbucket has to neutral
+		st = "STOPPED"
+	}
 
-	oururl := fmt.Sprintf("https://bitbucket.org/%v/%v", bc.Workspace, bc.Repository)
+	url := fmt.Sprintf("%v/repositories/%v/%v/commit/%v/statuses/build/%v", bitbucketApi, bc.Workspace, bc.Repository, hash, optionalKey)
 
-	// our descriptions are too long, so we ignore them
-	body := []byte(fmt.Sprintf(`{"key":"%v", "state":"%v", "description": "%v", "url": "%v"}`, comment, st, description, oururl))
+	body := bitbucketStatus{
+		Key:         comment,
+		State:       st,
+		Description: description,
+		Url:         fmt.Sprintf("https://bitbucket.org/%v/%v", bc.Workspace, bc.Repository),
+	}
 
-	r, err := http.NewRequest(method, url, bytes.NewBuffer(body))
-	if err != nil {
-		return fmt.Errorf("Failed to start post: %v", err)
+	if err := forgeCall(method, url, bc.apiHeaders(), body, nil); err != nil {
+		return fmt.Errorf("Error posting bitbucket status: %w", err)
 	}
-	r.Header.Add("Accept", "application/json")
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", fmt.Sprintf("Bearer %v", bc.Token))
+	return nil
+}
 
-	client := &http.Client{}
-	res, err := client.Do(r)
-	if err != nil {
-		return fmt.Errorf("Error posting github status: %v", err)
+func (bc *BitbucketConfiguration) apiHeaders() map[string]string {
+	headers := map[string]string{"Accept": "application/json"}
+	if bc.Token != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %v", bc.Token.Value())
 	}
+	return headers
+}
 
-	body, _ = io.ReadAll(res.Body)
+var _ StatusReader = &BitbucketConfiguration{}
 
-	res.Body.Close()
+func (bc *BitbucketConfiguration) HasStatus(comment, hash string) (bool, error) {
+	if bc.Token == "" {
+		// we can't have posted one
+		return false, nil
+	}
 
-	switch res.StatusCode {
-	case 200, 201:
-		// ok
+	reply := struct {
+		Values []struct {
+			Key string
+		}
+	}{}
+	url := fmt.Sprintf("%v/repositories/%v/%v/commit/%v/statuses?pagelen=100", bitbucketApi, bc.Workspace, bc.Repository, hash)
+	status, err := forgeGet(url, bc.apiHeaders(), &reply)
+	if err != nil {
+		return false, err
+	}
+	if status != 200 {
+		return false, fmt.Errorf("Bitbucket refused to list statuses for %v (%v)", hash, status)
+	}
 
-	default:
-		fmt.Println(res.StatusCode)
-		fmt.Println(string(body))
+	// we use the comment as the key
+	for _, s := range reply.Values {
+		if s.Key == comment {
+			return true, nil
+		}
 	}
-	return nil
+	return false, nil
 }
@@ -13,6 +13,7 @@ THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR I
 package main
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 )
@@ -24,6 +25,12 @@ const (
 	KFailed
 	KError
 	KSucceeded
+
+	// Deliberately not tested
+	KSkipped
+
+	// Not tested (or stopped) as a newer commit was pushed
+	KSuperseded
 )
 
 type RepoSource interface {
@@ -40,6 +47,41 @@ type RepoSource interface {
 	GitUrl() string
 }
 
+// Extra information on a result, for forges that can show more than a status line
+type StatusDetail struct {
+	// Command to reproduce the check locally
+	Command string
+
+	// Nix's log output ("" while in progress)
+	Log string
+}
+
+// Only as much of the log as a forge will show, so the outbox doesn't keep (and rewrite) whole logs
+func (sd StatusDetail) Trimmed() StatusDetail {
+	sd.Log = LogTail(sd.Log, kCheckTextLines, kCheckTextLimit)
+	return sd
+}
+
+// Optionally implemented by a RepoSource that can show a StatusDetail
+type DetailedRepoSource interface {
+	SetDetailedStatus(status CiStatus, comment, description, hash string, detail StatusDetail) error
+}
+
+// Optionally implemented by a RepoSource that can read statuses back
+// Skipped commits count as having a status on every forge, so backfill doesn't test them: Bitbucket and Forgejo
+// show a neutral status, but Github's commit statuses have no neutral state (and an untested commit mustn't look
+// like it passed) so none is posted, and the local repository records the skip instead (see SkipCommit)
+type StatusReader interface {
+	// True if the commit already has a status with this context (comment)
+	HasStatus(comment, hash string) (bool, error)
+}
+
+// Optionally implemented by a RepoSource that needs extra environment for git
+// This is passed to git when cloning/fetching, and to nix so its own git fetches match
+type GitEnvSource interface {
+	GitEnv() ([]string, error)
+}
+
 type Operation struct {
 	Source RepoSource
 
@@ -48,38 +90,125 @@ type Operation struct {
 
 	// The hash path
 	Hash string
+
+	// Don't test this commit, just mark it as skipped
+	Skip bool
+
+	// If this fails, bisect back to these commits (known to be good) to find the first failure
+	BisectFrom []string
+
+	// The branch the commit is on
+	Branch string
+
+	// Stop testing this commit if the branch moves on
+	Autocancel bool
+
+	// Runs the checks, as configured for the repository
+	Runner Runner
 }
 
-func (c Configuration) Execute(op Operation) error {
-	name := c.ResolvedName()
+// Set a status, with detail if the source can show it
+func (op Operation) SetStatus(status CiStatus, name, description string, detail StatusDetail) error {
+	if op.Source == nil {
+		return nil
+	}
+
+	if ds, ok := op.Source.(DetailedRepoSource); ok {
+		return ds.SetDetailedStatus(status, name, description, op.Hash, detail)
+	}
+	return op.Source.SetStatus(status, name, description, op.Hash)
+}
 
+// Test a commit, and post the result
+// If ctx is cancelled the test is stopped and ctx.Err() returned, leaving the caller to post a status
+func (c Configuration) Execute(ctx context.Context, op Operation) (CiStatus, error) {
 	description := GetDescription(op.Hash, op.Source)
 	fmt.Println("Test ", description)
 
-	if op.Source != nil {
-		op.Source.SetStatus(KInProgress, name, "", op.Hash)
+	detail := StatusDetail{Command: description}
+
+	c.PostStatus(op, KInProgress, "", detail)
+	c.markRunning(op, true)
+
+	// errors that aren't the commit's fault may go away if we try again
+	policy := c.Retry.ResolvedNix()
+	retries := 0
+	result, err := c.RunChecks(ctx, op.Runner, op.Repo, op.Hash)
+	for err == nil && retries < policy.Attempts && (result.Outcome == KInfraError || result.Outcome == KFetchError) {
+		retries += 1
+		fmt.Println("  ", result.Outcome, ", retry ", retries, " of ", policy.Attempts, " in ", policy.Delay(retries))
+		if !policy.Wait(ctx, retries) {
+			break
+		}
+		result, err = c.RunChecks(ctx, op.Runner, op.Repo, op.Hash)
+	}
+	if ctx.Err() != nil {
+		// still marked as running, so the caller (or the next run) can deal with it
+		fmt.Println("  Cancelled")
+		return KInProgress, err
 	}
-	ok, err := c.RunChecks(op.Repo.Path, op.Hash)
+	defer c.clearRunning(op)
+
 	if err != nil {
-		if op.Source != nil {
-			op.Source.SetStatus(KError, name, description, op.Hash)
-		}
-		return err
+		detail.Log = err.Error()
+		c.PostStatus(op, KError, fmt.Sprintf("%v: %v", KInfraError, description), detail)
+		return KError, err
 	}
 
-	if ok {
-		if op.Source != nil {
-			op.Source.SetStatus(KSucceeded, name, description, op.Hash)
-		}
+	detail.Log = result.Log
+	status := result.Outcome.Status()
+	switch result.Outcome {
+	case KPassed:
 		fmt.Println("  Passed!")
-	} else {
-		if op.Source != nil {
-			op.Source.SetStatus(KFailed, name, description, op.Hash)
+		if op.Branch != "" {
+			if err := op.Repo.NotePassed(op.Branch, op.Hash); err != nil {
+				fmt.Println("error: ", err)
+			}
 		}
-		fmt.Println("  Failed!")
+
+	case KTimedOut:
+		description = fmt.Sprintf("Timed out after %v: %v", c.TimeoutDuration(), description)
+		fmt.Println("  Timed out!")
+
+	default:
+		description = fmt.Sprintf("%v: %v", result.Outcome, description)
+		fmt.Println("  " + result.Outcome.String() + "!")
 	}
 
-	return nil
+	c.PostStatus(op, status, description+retriesNote(retries), detail)
+	return status, nil
+}
+
+// The local copy of a repository, cloning it if we don't have it yet
+// The bool is true if it was cloned
+func (c Configuration) OpenRepository(varFolder string, repo RepositoryConfiguration) (Repository, bool, error) {
+	r := Repository{
+		Path: filepath.Join(varFolder, repo.Identifier()),
+	}
+	if c.Verbose {
+		fmt.Println(" Repository ", r.Path)
+	}
+
+	source := repo.Source()
+	if ges, ok := source.(GitEnvSource); ok {
+		env, err := ges.GitEnv()
+		if err != nil {
+			return r, false, err
+		}
+		r.Env = env
+	}
+
+	if r.Exists() {
+		return r, false, nil
+	}
+
+	if c.Verbose {
+		fmt.Println("  Clone ", source.GitUrl(), repo.Branch)
+	}
+	if err := r.Clone(source.GitUrl(), repo.Branch); err != nil {
+		return r, false, err
+	}
+	return r, true, nil
 }
 
 // Perform a single tick
@@ -90,23 +219,19 @@ func (c Configuration) GatherNewCommits(varFolder string) ([]Operation, error) {
 
 	ops := []Operation{}
 
-	for _, repo := range c.Repositories {
-		r := Repository{
-			Path: filepath.Join(varFolder, repo.Identifier()),
-		}
-		if c.Verbose {
-			fmt.Println(" Repository ", r.Path)
+	for _, repo := range c.AllRepositories() {
+		r, cloned, err := c.OpenRepository(varFolder, repo)
+		if err != nil {
+			return nil, err
 		}
 
-		source := repo.Source()
-
-		if !r.Exists() {
-			if c.Verbose {
-				fmt.Println("  Clone ", source.GitUrl(), repo.Branch)
-			}
-			if err := r.Clone(source.GitUrl(), repo.Branch); err != nil {
+		if cloned && repo.Backfill != nil {
+			// a new repository, so test some of its history
+			backfill, err := c.BackfillOperations(repo, r, repo.Branch, *repo.Backfill)
+			if err != nil {
 				return nil, err
 			}
+			ops = append(ops, backfill...)
 		}
 
 		commitsBefore, err := r.ListCommits(repo.Branch)
@@ -117,10 +242,18 @@ func (c Configuration) GatherNewCommits(varFolder string) ([]Operation, error) {
 			fmt.Println("  ", len(commitsBefore), " commits before fetch")
 		}
 
+		tipBefore, err := r.ResolveRevision(repo.Branch)
+		if err != nil {
+			tipBefore = ""
+		}
+
 		if c.Verbose {
 			fmt.Println("  Fetch")
 		}
-		if err := r.Fetch(repo.Branch); err != nil {
+		_, err = c.Retry.ResolvedFetch().Do(context.Background(), "Fetch", func() error {
+			return r.Fetch(repo.Branch)
+		})
+		if err != nil {
 			return nil, err
 		}
 
@@ -129,56 +262,190 @@ func (c Configuration) GatherNewCommits(varFolder string) ([]Operation, error) {
 			return nil, err
 		}
 		if c.Verbose {
-			fmt.Println("  ", len(commitsBefore), " commits after fetch")
+			fmt.Println("  ", len(commitsAfter), " commits after fetch")
 		}
 
-		for hash, _ := range commitsAfter {
-			_, fnd := commitsBefore[hash]
-			if fnd {
+		known := map[string]bool{}
+		for _, hash := range commitsBefore {
+			known[hash] = true
+		}
+
+		newCommits := []string{}
+		for _, hash := range commitsAfter {
+			if known[hash] {
 				continue
 			}
-			if c.Verbose {
-				fmt.Println("  New commit ", hash)
-			}
+			newCommits = append(newCommits, hash)
+		}
 
-			op := Operation{
-				Repo:   r,
-				Hash:   hash,
-				Source: repo.Source(),
-			}
-			ops = append(ops, op)
+		chosen, err := c.StrategyOperations(repo, r, newCommits, tipBefore)
+		if err != nil {
+			return nil, err
 		}
+		ops = append(ops, chosen...)
 	}
 
 	return ops, nil
 }
 
+// Put commits (newest first, as git lists them) into the order they should be tested in
+func (c Configuration) OrderCommits(hashes []string) []string {
+	if c.ResolvedOrder() == KOrderNewest {
+		return hashes
+	}
+
+	ordered := make([]string, len(hashes))
+	for i, hash := range hashes {
+		ordered[len(hashes)-1-i] = hash
+	}
+	return ordered
+}
+
+// Test a revision of a repository again, fetching it if needed
+func (c Configuration) Rebuild(sd *Shutdown, name, revision string) error {
+	repo, err := c.FindRepository(name)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := c.OpenRepository(c.VarFolder(), repo)
+	if err != nil {
+		return err
+	}
+
+	hash, err := r.FetchRevision(revision)
+	if err != nil {
+		return err
+	}
+
+	runner, err := c.RunnerFor(repo)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Execute(sd.Context(), Operation{
+		Repo:   r,
+		Hash:   hash,
+		Source: repo.Source(),
+		Branch: repo.Branch,
+		Runner: runner,
+	})
+	return err
+}
+
 func (c Configuration) Validate() error {
-	for i, repo := range c.Repositories {
-		if repo.Source() == nil {
-			return fmt.Errorf("Invalid configuration: missing repository source (%v)", i)
-		}
+	ces := c.Problems()
+	if len(ces) > 0 {
+		return fmt.Errorf("Invalid configuration:\n%v", ces)
 	}
 	return nil
 }
 
-func (c Configuration) Tick() error {
+// Test the new commits, stopping early if sd says so
+func (c Configuration) Tick(sd *Shutdown) error {
 	if err := c.Validate(); err != nil {
 		return err
 	}
 
-	varFolder := filepath.Join(c.Var, "v1")
+	varFolder := c.VarFolder()
+
+	if err := c.RefreshDiscovery(); err != nil {
+		// carry on with the repositories we already know about
+		fmt.Println("error: ", err)
+	}
+
+	if err := c.FlushOutbox(); err != nil {
+		fmt.Println("error: ", err)
+	}
 
 	ops, err := c.GatherNewCommits(varFolder)
 	if err != nil {
 		return err
 	}
 
+	// those left over from the last run go first
+	orphans, err := c.OrphanOperations()
+	if err != nil {
+		fmt.Println("error: ", err)
+	}
+	ops = append(orphans, ops...)
+
+	for _, op := range ops {
+		if !op.Skip {
+			c.markRunning(op, false)
+		}
+	}
+
+	// mark the skipped commits first, so the forge isn't left waiting on them
+	for _, op := range ops {
+		if op.Skip {
+			if err := c.SkipCommit(op); err != nil {
+				fmt.Println("error: ", err)
+			}
+		}
+	}
+
+	// commits that passed this tick, by repository
+	passed := map[string][]string{}
+
+	// the new tip of branches that moved on while we were testing, by repository
+	superseded := map[string]string{}
+
 	for _, op := range ops {
-		err := c.Execute(op)
+		if op.Skip {
+			continue
+		}
+
+		if sd.Stopping() {
+			fmt.Println("Stopping, the remaining commits will be tested next time")
+			return nil
+		}
+
+		if newTip := superseded[op.Repo.Path]; newTip != "" && op.Autocancel {
+			c.SupersedeCommit(op, newTip)
+			continue
+		}
+
+		ctx := sd.Context()
+		var watch *branchWatch
+		if op.Autocancel {
+			ctx, watch = c.WatchBranch(ctx, op)
+		}
+
+		status := KInProgress
+		err := ctx.Err()
+		if err == nil {
+			status, err = c.Execute(ctx, op)
+		}
+
+		if watch != nil {
+			if newTip := watch.Stop(); newTip != "" {
+				superseded[op.Repo.Path] = newTip
+				if status == KInProgress {
+					// cancelled (or never started), rather than finished
+					c.SupersedeCommit(op, newTip)
+					continue
+				}
+			}
+		}
+		if sd.Context().Err() != nil {
+			fmt.Println("Stopped, killed running tests")
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+
+		switch {
+		case status == KSucceeded:
+			passed[op.Repo.Path] = append(passed[op.Repo.Path], op.Hash)
+
+		case status == KFailed && op.BisectFrom != nil && superseded[op.Repo.Path] == "":
+			good := append(append([]string{}, op.BisectFrom...), passed[op.Repo.Path]...)
+			if _, err := c.BisectFailure(sd.Context(), op, good); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
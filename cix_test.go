@@ -0,0 +1,319 @@
+/*
+cix_test.go - End to end tests of a tick
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func githubRepository(branch string) string {
+	return fmt.Sprintf(`{"github": {"user": "owner", "repository": "repo", "statuspat": "pat"}, "branch": %q}`, branch)
+}
+
+func TestGithubTestsNewCommitsOldestFirst(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+
+	// the first tick clones, and there is nothing new yet
+	h.Tick(c)
+	if tested := h.Tested(); len(tested) != 0 {
+		t.Fatalf("tested %v on clone", tested)
+	}
+
+	first := remote.Commit("first")
+	second := remote.Commit("second")
+	h.Tick(c)
+
+	if tested := h.Tested(); !reflect.DeepEqual(tested, []string{first, second}) {
+		t.Fatalf("tested %v, expected %v", tested, []string{first, second})
+	}
+
+	for _, hash := range []string{first, second} {
+		statuses := h.forge.StatusesFor(hash)
+		if len(statuses) != 2 || statuses[0].State != "pending" || statuses[1].State != "success" {
+			t.Errorf("statuses for %v: %+v", hash, statuses)
+		}
+		if statuses[0].Forge != "github" || statuses[0].Context != c.ResolvedName() {
+			t.Errorf("posted to %v as %v", statuses[0].Forge, statuses[0].Context)
+		}
+	}
+
+	// and nothing is tested twice
+	h.Tick(c)
+	if tested := h.Tested(); len(tested) != 2 {
+		t.Fatalf("tested %v", tested)
+	}
+}
+
+func TestBitbucketFailure(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@bitbucket.org:workspace/repo")
+	c := h.Configuration("", `{"bitbucket": {"workspace": "workspace", "repository": "repo", "token": "token"}, "branch": "main"}`)
+	h.Tick(c)
+
+	bad := remote.Commit("broken")
+	h.FailNix(bad)
+	h.Tick(c)
+
+	if state := h.forge.LastState(bad); state != "FAILED" {
+		t.Fatalf("status %v, expected FAILED", state)
+	}
+	statuses := h.forge.StatusesFor(bad)
+	if statuses[0].State != "INPROGRESS" || statuses[0].Forge != "bitbucket" {
+		t.Errorf("first status %+v", statuses[0])
+	}
+}
+
+func TestForgejoSuccess(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote(fmt.Sprintf("git@%v:owner/repo.git", h.forge.Host()))
+	c := h.Configuration("", fmt.Sprintf(`{"forgejo": {"domain": %q, "user": "owner", "repository": "repo", "token": "token", "ssh": true}, "branch": "main"}`, h.forge.Host()))
+	h.Tick(c)
+
+	good := remote.Commit("good")
+	h.Tick(c)
+
+	if state := h.forge.LastState(good); state != "success" {
+		t.Fatalf("status %v, expected success", state)
+	}
+	if forge := h.forge.StatusesFor(good)[0].Forge; forge != "forgejo" {
+		t.Errorf("posted to %v", forge)
+	}
+}
+
+func TestTipStrategyBisectsFailures(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", `{"github": {"user": "owner", "repository": "repo", "statuspat": "pat"}, "branch": "main", "strategy": "tip", "bisect": true}`)
+	h.Tick(c)
+
+	// a tip that passed, for the bisection to start from
+	remote.Commit("good")
+	h.Tick(c)
+	before := len(h.Tested())
+
+	hashes := []string{}
+	for i := 0; i < 6; i++ {
+		hashes = append(hashes, remote.Commit(fmt.Sprintf("commit %v", i)))
+	}
+	// commit 3 breaks the build, and it stays broken
+	for _, hash := range hashes[3:] {
+		h.FailNix(hash)
+	}
+	h.Tick(c)
+
+	tested := h.Tested()[before:]
+	tip := hashes[len(hashes)-1]
+	if len(tested) == 0 || tested[0] != tip {
+		t.Fatalf("tested %v, expected the tip first", tested)
+	}
+
+	if state := h.forge.LastState(hashes[3]); state != "failure" {
+		t.Errorf("first failure has status %v", state)
+	}
+	if state := h.forge.LastState(hashes[2]); state != "success" {
+		t.Errorf("last good commit has status %v", state)
+	}
+
+	// bisection tests fewer commits than testing all of them would
+	if len(tested) >= len(hashes) {
+		t.Errorf("tested %v commits of %v", len(tested), len(hashes))
+	}
+
+	// github statuses have no neutral state, so skipped commits are left without one
+	wasTested := map[string]bool{}
+	for _, hash := range tested {
+		wasTested[hash] = true
+	}
+	for i, hash := range hashes {
+		state := h.forge.LastState(hash)
+		broken := i >= 3
+
+		switch {
+		case broken && state == "success":
+			t.Errorf("broken commit %v has status success", i)
+
+		case !wasTested[hash] && state != "":
+			t.Errorf("skipped commit %v has status %v", i, state)
+
+		case wasTested[hash] && broken && state != "failure":
+			t.Errorf("broken commit %v was tested, but has status %v", i, state)
+
+		case wasTested[hash] && !broken && state != "success":
+			t.Errorf("good commit %v was tested, but has status %v", i, state)
+		}
+	}
+}
+
+// A tip that failed is no base for a bisection, so only the new tip is tested
+func TestTipStrategyDoesntBisectFromAFailure(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", `{"github": {"user": "owner", "repository": "repo", "statuspat": "pat"}, "branch": "main", "strategy": "tip", "bisect": true}`)
+	h.Tick(c)
+
+	broken := remote.Commit("broken")
+	h.FailNix(broken)
+	h.Tick(c)
+
+	// fixed, then broken again
+	fixed := remote.Commit("fixed")
+	again := remote.Commit("broken again")
+	h.FailNix(again)
+	h.Tick(c)
+
+	expected := []string{broken, again}
+	if tested := h.Tested(); !reflect.DeepEqual(tested, expected) {
+		t.Fatalf("tested %v, expected %v", tested, expected)
+	}
+	if state := h.forge.LastState(fixed); state != "" {
+		t.Errorf("the fixed commit has status %v", state)
+	}
+	if state := h.forge.LastState(again); state != "failure" {
+		t.Errorf("the tip has status %v", state)
+	}
+}
+
+func TestOutboxDeliversLater(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+
+	hash := remote.Commit("while the forge is down")
+
+	// both the pending and the result are refused
+	h.forge.FailNext(2)
+	h.Tick(c)
+
+	if statuses := h.forge.StatusesFor(hash); len(statuses) != 0 {
+		t.Fatalf("forge accepted %+v while down", statuses)
+	}
+	if size := c.OutboxSize(); size != 1 {
+		t.Fatalf("outbox has %v entries, expected the latest status only", size)
+	}
+
+	// forge is back, but the entry isn't due yet
+	if err := c.FlushOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if size := c.OutboxSize(); size != 1 {
+		t.Fatalf("outbox delivered early")
+	}
+
+	// pretend time has passed
+	makeOutboxDue(t, c)
+
+	if err := c.FlushOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if state := h.forge.LastState(hash); state != "success" {
+		t.Fatalf("status %v after flush, expected success", state)
+	}
+	if size := c.OutboxSize(); size != 0 {
+		t.Fatalf("outbox has %v entries after delivery", size)
+	}
+}
+
+// Only the end of a long log is kept in the outbox, as that is all a forge is sent
+func TestOutboxKeepsTheLogTail(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+
+	repo := c.AllRepositories()[0]
+	op := Operation{
+		Repo:   Repository{Path: filepath.Join(c.VarFolder(), repo.Identifier())},
+		Hash:   remote.Commit("noisy"),
+		Source: repo.Source(),
+	}
+
+	log := strings.Repeat("building\n", 100000) + "error: the end"
+	h.forge.FailNext(1)
+	c.PostStatus(op, KFailed, "Failed", StatusDetail{Log: log})
+
+	entries, err := c.readOutbox()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("outbox has %v (%v)", entries, err)
+	}
+	kept := entries[0].Detail.Log
+	if len(kept) > kCheckTextLimit || !strings.HasSuffix(kept, "error: the end") {
+		t.Errorf("kept %v bytes of the log, ending %q", len(kept), kept[len(kept)-20:])
+	}
+}
+
+func TestFetchFailuresAreRetried(t *testing.T) {
+	h := newHarness(t)
+	h.Retry = `{"status": {"attempts": -1}, "fetch": {"attempts": 2, "backoff": 1}}`
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+
+	hash := remote.Commit("after a flaky fetch")
+	h.FailFetches(2)
+	h.Tick(c)
+
+	if state := h.forge.LastState(hash); state != "success" {
+		t.Fatalf("status %v, expected success", state)
+	}
+
+	// and when the retries run out, the tick fails
+	another := remote.Commit("after a broken fetch")
+	h.FailFetches(3)
+	if err := c.Tick(nil); err == nil {
+		t.Fatalf("tick succeeded without fetching")
+	}
+	if tested := h.Tested(); len(tested) != 1 {
+		t.Fatalf("tested %v", tested)
+	}
+
+	// it is picked up once the remote is back
+	h.Tick(c)
+	if state := h.forge.LastState(another); state != "success" {
+		t.Fatalf("status %v, expected success", state)
+	}
+}
+
+func TestNixInfrastructureErrorsAreRetried(t *testing.T) {
+	h := newHarness(t)
+	h.Retry = `{"status": {"attempts": -1}, "nix": {"attempts": 1, "backoff": 1}}`
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+
+	hash := remote.Commit("on a flaky machine")
+	h.BreakNix(1)
+	h.Tick(c)
+
+	if tested := h.Tested(); !reflect.DeepEqual(tested, []string{hash, hash}) {
+		t.Fatalf("tested %v, expected %v twice", tested, hash)
+	}
+	statuses := h.forge.StatusesFor(hash)
+	if last := statuses[len(statuses)-1]; last.State != "success" || !strings.HasSuffix(last.Description, "(after 1 retry)") {
+		t.Fatalf("last status %+v", last)
+	}
+
+	// an error, not a failure, when it keeps happening
+	broken := remote.Commit("on a broken machine")
+	h.BreakNix(2)
+	h.Tick(c)
+
+	if state := h.forge.LastState(broken); state != "error" {
+		t.Fatalf("status %v, expected error", state)
+	}
+}
@@ -14,6 +14,9 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type RepositoryConfiguration struct {
@@ -31,6 +34,30 @@ type RepositoryConfiguration struct {
 
 	// The branch to check
 	Branch string
+
+	// (optional) Name of a template to start from
+	Template string
+
+	// (optional) History to test when the repository is first cloned
+	Backfill *BackfillConfiguration
+
+	// (optional) Which new commits to test, all (default), tip, tip+first-parent or every
+	Strategy string
+
+	// (optional) With the every strategy, test every Nth commit
+	Every int
+
+	// (optional) Bisect skipped commits to find the first failure when a test fails
+	Bisect bool
+
+	// (optional) Stop testing commits when a newer one is pushed to the branch
+	Autocancel bool
+
+	// (optional) How checks are run, local (default) or systemd
+	Runner string
+
+	// (optional) Resource limits for the systemd runner
+	Systemd *SystemdConfiguration
 }
 
 func (rc RepositoryConfiguration) Source() RepoSource {
@@ -53,6 +80,99 @@ func (rc RepositoryConfiguration) Source() RepoSource {
 	return nil
 }
 
+// The json names of the source blocks set, valid or not
+func (rc RepositoryConfiguration) SourceNames() []string {
+	names := []string{}
+	if rc.Bitbucket != nil {
+		names = append(names, "bitbucket")
+	}
+	if rc.Github != nil {
+		names = append(names, "github")
+	}
+	if rc.Ssh != nil {
+		names = append(names, "ssh")
+	}
+	if rc.Forgejo != nil {
+		names = append(names, "forgejo")
+	}
+	return names
+}
+
+// A human readable name for the repository, e.g. for the command line
+func (rc RepositoryConfiguration) Name() string {
+	switch {
+	case rc.Bitbucket.Valid():
+		return fmt.Sprintf("bitbucket:%v/%v", rc.Bitbucket.Workspace, rc.Bitbucket.Repository)
+
+	case rc.Github.Valid():
+		return fmt.Sprintf("github:%v/%v", rc.Github.User, rc.Github.Repository)
+
+	case rc.Ssh.Valid():
+		return rc.Ssh.Remote
+
+	case rc.Forgejo.Valid():
+		return fmt.Sprintf("forgejo:%v/%v/%v", rc.Forgejo.Domain, rc.Forgejo.User, rc.Forgejo.Repository)
+	}
+	return ""
+}
+
+// True if this is the repository a user means by name
+// That can be the full name, the name without the forge, either with an @branch, or a prefix of the identifier
+func (rc RepositoryConfiguration) Matches(name string) bool {
+	if len(name) >= 6 && strings.HasPrefix(rc.Identifier(), name) {
+		return true
+	}
+
+	full := rc.Name()
+	short := full
+	if i := strings.Index(full, ":"); i >= 0 && !rc.Ssh.Valid() {
+		short = full[i+1:]
+	}
+
+	for _, candidate := range []string{full, short} {
+		if name == candidate || name == candidate+"@"+rc.Branch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Configuration) matchingRepositories(name string) []RepositoryConfiguration {
+	found := []RepositoryConfiguration{}
+	for _, rc := range c.AllRepositories() {
+		if rc.Matches(name) {
+			found = append(found, rc)
+		}
+	}
+	return found
+}
+
+// The repository a user means by name
+func (c Configuration) FindRepository(name string) (RepositoryConfiguration, error) {
+	found := c.matchingRepositories(name)
+	if len(found) == 0 && !c.DiscoveryCurrent() {
+		// it may have been created since we last discovered
+		if err := c.RefreshDiscovery(); err != nil {
+			return RepositoryConfiguration{}, err
+		}
+		found = c.matchingRepositories(name)
+	}
+
+	switch len(found) {
+	case 0:
+		return RepositoryConfiguration{}, fmt.Errorf("No repository matches %v", name)
+
+	case 1:
+		return found[0], nil
+	}
+
+	names := []string{}
+	for _, rc := range found {
+		names = append(names, rc.Name()+"@"+rc.Branch)
+	}
+	return RepositoryConfiguration{}, fmt.Errorf("%v is ambiguous, it could be %v", name, strings.Join(names, ", "))
+}
+
 func (rc RepositoryConfiguration) Identifier() string {
 	h := sha256.New()
 	h.Write([]byte(rc.Source().GitUrl()))
@@ -79,8 +199,54 @@ type Configuration struct {
 	// Path to nix
 	NixPath string
 
+	// Path to the control socket
+	ControlSocket string
+
+	// (optional) Order to test new commits in, oldest (default) or newest first
+	Order string
+
+	// (optional) Seconds to wait for running tests when stopping, before killing them
+	ShutdownTimeout int
+
+	// (optional) What to do with commits that were being tested when Cix last stopped, requeue (default) or error
+	Orphans string
+
+	// (optional) How to retry things that fail for reasons outside the commit
+	Retry RetryConfiguration
+
 	// various git repos
 	Repositories []RepositoryConfiguration
+
+	// (optional) Files (or globs) with more repositories and templates
+	Include []string
+
+	// (optional) Settings every repository starts from
+	Defaults *RepositoryConfiguration
+
+	// (optional) Named settings a repository can start from
+	Templates map[string]RepositoryConfiguration
+
+	// (optional) Forge users/organisations to find more repositories in
+	Discover []DiscoveryConfiguration
+
+	// (optional) Seconds between discoveries
+	DiscoveryInterval int
+
+	// the repositories last discovered
+	discovered *discoveryCache
+
+	// the files this was read from
+	files []string
+}
+
+// The files the configuration was read from
+func (c Configuration) Files() []string {
+	return c.files
+}
+
+// Where we keep our copies of the repositories
+func (rc Configuration) VarFolder() string {
+	return filepath.Join(rc.Var, "v1")
 }
 
 func (rc Configuration) ResolvedPollingInterval() int {
@@ -99,6 +265,10 @@ func (rc Configuration) ResolvedTimeout() int {
 	return rc.Timeout
 }
 
+func (rc Configuration) TimeoutDuration() time.Duration {
+	return time.Duration(rc.ResolvedTimeout()) * time.Second
+}
+
 func (rc Configuration) ResolvedNixPath() string {
 	if rc.NixPath == "" {
 		// hope it is in the path
@@ -108,6 +278,19 @@ func (rc Configuration) ResolvedNixPath() string {
 	return rc.NixPath
 }
 
+const (
+	KOrderOldest = "oldest"
+	KOrderNewest = "newest"
+)
+
+func (rc Configuration) ResolvedOrder() string {
+	if rc.Order == "" {
+		return KOrderOldest
+	}
+
+	return rc.Order
+}
+
 func (rc Configuration) ResolvedName() string {
 	if rc.Name == "" {
 		return "Cix"
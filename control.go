@@ -0,0 +1,224 @@
+/*
+control.go - Control socket for a running Cix
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+// The control socket is HTTP over a unix socket, so it can be driven with curl as well as the cli
+//
+//	curl --unix-socket $VAR/cix.sock -X POST 'http://cix/rebuild?repository=owner/repo&revision=main'
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Work asked for through the socket, run by the main loop with the configuration at the time
+type ControlJob func(c Configuration, sd *Shutdown) error
+
+// Returned when no cix is listening on the socket
+var errNoDaemon = errors.New("Cix is not running")
+
+type ControlServer struct {
+	socket   string
+	listener net.Listener
+	server   *http.Server
+	requests chan ControlJob
+
+	lock   sync.Mutex
+	config Configuration
+}
+
+func (c Configuration) ResolvedControlSocket() string {
+	if c.ControlSocket == "" {
+		return filepath.Join(c.Var, "cix.sock")
+	}
+
+	return os.ExpandEnv(c.ControlSocket)
+}
+
+// Listen on the control socket
+func StartControlServer(c Configuration) (*ControlServer, error) {
+	socket := c.ResolvedControlSocket()
+	os.MkdirAll(filepath.Dir(socket), 0777)
+
+	if _, err := os.Stat(socket); err == nil {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Cix is already running (control socket %v)", socket)
+		}
+		// left behind by a cix that didn't exit cleanly
+		os.Remove(socket)
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on control socket %v: %v", socket, err)
+	}
+	// only our user may ask for builds
+	os.Chmod(socket, 0600)
+
+	cs := &ControlServer{
+		socket:   socket,
+		listener: listener,
+		requests: make(chan ControlJob, 100),
+		config:   c,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rebuild", cs.handleRebuild)
+	mux.HandleFunc("/backfill", cs.handleBackfill)
+	cs.server = &http.Server{Handler: mux}
+	go cs.server.Serve(listener)
+
+	return cs, nil
+}
+
+// Use a new configuration for requests
+func (cs *ControlServer) SetConfiguration(c Configuration) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.config = c
+}
+
+// Jobs asked for, to be run by the main loop
+func (cs *ControlServer) Requests() <-chan ControlJob {
+	return cs.requests
+}
+
+func (cs *ControlServer) Close() error {
+	err := cs.server.Close()
+	os.Remove(cs.socket)
+	return err
+}
+
+// Check the repository named in a request exists, so the caller hears about typos
+func (cs *ControlServer) findRepository(w http.ResponseWriter, r *http.Request) (RepositoryConfiguration, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return RepositoryConfiguration{}, false
+	}
+
+	name := r.FormValue("repository")
+	if name == "" {
+		http.Error(w, "repository is required", http.StatusBadRequest)
+		return RepositoryConfiguration{}, false
+	}
+
+	cs.lock.Lock()
+	repo, err := cs.config.FindRepository(name)
+	cs.lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return RepositoryConfiguration{}, false
+	}
+	return repo, true
+}
+
+func (cs *ControlServer) enqueue(w http.ResponseWriter, job ControlJob, description string) {
+	select {
+	case cs.requests <- job:
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Queued %v\n", description)
+
+	default:
+		http.Error(w, "Too many jobs queued", http.StatusServiceUnavailable)
+	}
+}
+
+func (cs *ControlServer) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	repo, ok := cs.findRepository(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.FormValue("repository")
+	revision := r.FormValue("revision")
+	if revision == "" {
+		http.Error(w, "revision is required", http.StatusBadRequest)
+		return
+	}
+	if !ValidRevision(revision) {
+		http.Error(w, "bad revision", http.StatusBadRequest)
+		return
+	}
+
+	cs.enqueue(w, func(c Configuration, sd *Shutdown) error {
+		return c.Rebuild(sd, name, revision)
+	}, fmt.Sprintf("rebuild of %v of %v@%v", revision, repo.Name(), repo.Branch))
+}
+
+func (cs *ControlServer) handleBackfill(w http.ResponseWriter, r *http.Request) {
+	repo, ok := cs.findRepository(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.FormValue("repository")
+	bf := BackfillConfiguration{Since: r.FormValue("since")}
+	if count := r.FormValue("count"); count != "" {
+		if _, err := fmt.Sscan(count, &bf.Count); err != nil {
+			http.Error(w, "count must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	if bf.Count == 0 && bf.Since == "" {
+		http.Error(w, "count or since is required", http.StatusBadRequest)
+		return
+	}
+	if bf.Since != "" && !ValidRevision(bf.Since) {
+		http.Error(w, "bad since", http.StatusBadRequest)
+		return
+	}
+
+	cs.enqueue(w, func(c Configuration, sd *Shutdown) error {
+		return c.Backfill(sd, name, bf)
+	}, fmt.Sprintf("backfill of %v@%v", repo.Name(), repo.Branch))
+}
+
+// Ask a running cix to do something, errNoDaemon if there isn't one
+func SendControl(socket, path string, form url.Values) (string, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	res, err := client.PostForm("http://cix"+path, form)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return "", errNoDaemon
+		}
+		return "", fmt.Errorf("Failed to ask cix to %v: %v", path, err)
+	}
+
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	reply := strings.TrimSpace(string(body))
+	if res.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("Cix refused: %v", reply)
+	}
+	return reply, nil
+}
@@ -0,0 +1,579 @@
+/*
+discover.go - Discovering repositories to test
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A GitLab group to discover repositories in
+// Cix can't post statuses to GitLab, so these are pulled over ssh
+type GitlabDiscovery struct {
+	// Domain of the GitLab instance, e.g. gitlab.com
+	Domain string
+
+	// The group path, e.g. example/backend
+	Group string
+
+	// (optional) An access token with read_api
+	Token Secret
+}
+
+type DiscoveryConfiguration struct {
+	// Settings for the discovered repositories
+	// The source block names the user, organisation or workspace, rather than a repository
+	// If the branch is left out, each repository's default branch is tested
+	Repository RepositoryConfiguration
+
+	// (optional) Discover in a GitLab group instead
+	Gitlab *GitlabDiscovery
+
+	// (optional) Globs on the repository name, defaults to all repositories
+	Include []string
+
+	// (optional) Globs on the repository name to leave out
+	Exclude []string
+
+	// (optional) Only repositories with a flake.nix on the branch
+	RequireFlake bool
+}
+
+// A repository a forge listed
+type discoveredRepository struct {
+	Name          string
+	DefaultBranch string
+
+	// ssh remote, only for GitLab
+	Remote string
+
+	// The branch we test, once chosen
+	Branch string
+}
+
+// Something that can list repositories
+type repositoryLister interface {
+	ListRepositories() ([]discoveredRepository, error)
+	HasFlake(repository discoveredRepository, branch string) (bool, error)
+}
+
+// The last discovery, shared by copies of a Configuration
+type discoveryCache struct {
+	lock         sync.Mutex
+	when         time.Time
+	repositories []RepositoryConfiguration
+}
+
+// What a discovery found, saved so commands and restarts know the repositories without asking the forge
+// The settings come from the configuration, so no credentials are saved
+type savedDiscovery struct {
+	// The discovery block, by its key
+	Discovery string
+
+	Repository discoveredRepository
+}
+
+// Identifies a discovery block, so saved results still match if the blocks are reordered
+func (dc DiscoveryConfiguration) key() string {
+	switch {
+	case dc.Gitlab != nil:
+		return "gitlab:" + dc.Gitlab.Domain + "/" + dc.Gitlab.Group
+	case dc.Repository.Github != nil:
+		return "github:" + dc.Repository.Github.User
+	case dc.Repository.Forgejo != nil:
+		return "forgejo:" + dc.Repository.Forgejo.Domain + "/" + dc.Repository.Forgejo.User
+	case dc.Repository.Bitbucket != nil:
+		return "bitbucket:" + dc.Repository.Bitbucket.Workspace
+	}
+	return ""
+}
+
+// Is the repository name wanted by the include/exclude globs
+func (dc DiscoveryConfiguration) Wanted(name string) bool {
+	included := len(dc.Include) == 0
+	for _, glob := range dc.Include {
+		if m, _ := path.Match(glob, name); m {
+			included = true
+		}
+	}
+
+	for _, glob := range dc.Exclude {
+		if m, _ := path.Match(glob, name); m {
+			return false
+		}
+	}
+	return included
+}
+
+func (dc DiscoveryConfiguration) lister() repositoryLister {
+	switch {
+	case dc.Gitlab != nil:
+		return dc.Gitlab
+	case dc.Repository.Github != nil:
+		return dc.Repository.Github
+	case dc.Repository.Forgejo != nil:
+		return dc.Repository.Forgejo
+	case dc.Repository.Bitbucket != nil:
+		return dc.Repository.Bitbucket
+	}
+	return nil
+}
+
+// The settings for a discovered repository
+func (dc DiscoveryConfiguration) repositoryFor(dr discoveredRepository, branch string) RepositoryConfiguration {
+	rc := dc.Repository
+	rc.Branch = branch
+
+	// the blocks are shared with the template, so each repository gets its own copy
+	switch {
+	case dc.Gitlab != nil:
+		ssh := SshConfiguration{}
+		if rc.Ssh != nil {
+			ssh = *rc.Ssh
+		}
+		ssh.Remote = dr.Remote
+		rc.Ssh = &ssh
+
+	case rc.Github != nil:
+		rc.Github = rc.Github.forRepository(dr.Name)
+
+	case rc.Forgejo != nil:
+		forgejo := *rc.Forgejo
+		forgejo.Repository = dr.Name
+		rc.Forgejo = &forgejo
+
+	case rc.Bitbucket != nil:
+		bitbucket := *rc.Bitbucket
+		bitbucket.Repository = dr.Name
+		rc.Bitbucket = &bitbucket
+	}
+	return rc
+}
+
+// List the repositories for one discovery block, with the branch to test
+func (dc DiscoveryConfiguration) Discover() ([]discoveredRepository, error) {
+	lister := dc.lister()
+	if lister == nil {
+		return nil, fmt.Errorf("Nothing to discover")
+	}
+
+	listed, err := lister.ListRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []discoveredRepository{}
+	for _, dr := range listed {
+		if !dc.Wanted(dr.Name) {
+			continue
+		}
+
+		branch := dc.Repository.Branch
+		if branch == "" {
+			branch = dr.DefaultBranch
+		}
+		if branch == "" {
+			// an empty repository
+			continue
+		}
+
+		if dc.RequireFlake {
+			has, err := lister.HasFlake(dr, branch)
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				continue
+			}
+		}
+
+		dr.Branch = branch
+		ret = append(ret, dr)
+	}
+	return ret, nil
+}
+
+func (c Configuration) ResolvedDiscoveryInterval() int {
+	if c.DiscoveryInterval == 0 {
+		return 60 * 60
+	}
+
+	return c.DiscoveryInterval
+}
+
+// Rediscover repositories if it is due
+// On error the previous discovery is kept
+func (c Configuration) RefreshDiscovery() error {
+	if len(c.Discover) == 0 || c.discovered == nil {
+		return nil
+	}
+
+	c.discovered.lock.Lock()
+	due := time.Since(c.discovered.when) > time.Duration(c.ResolvedDiscoveryInterval())*time.Second
+	c.discovered.lock.Unlock()
+	if !due {
+		return nil
+	}
+
+	saved := []savedDiscovery{}
+	for i, dc := range c.Discover {
+		repositories, err := dc.Discover()
+		if err != nil {
+			return fmt.Errorf("Discovery failed (discover[%v]): %v", i, err)
+		}
+		if c.Verbose {
+			fmt.Println(" Discovered ", len(repositories), " repositories (discover[", i, "])")
+		}
+		for _, dr := range repositories {
+			saved = append(saved, savedDiscovery{Discovery: dc.key(), Repository: dr})
+		}
+	}
+
+	c.useDiscovery(saved)
+	c.discovered.lock.Lock()
+	c.discovered.when = time.Now()
+	c.discovered.lock.Unlock()
+
+	blob, _ := json.Marshal(saved)
+	os.MkdirAll(c.Var, 0777)
+	if err := os.WriteFile(c.discoveryPath()+".tmp", blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(c.discoveryPath()+".tmp", c.discoveryPath())
+}
+
+func (c Configuration) discoveryPath() string {
+	return filepath.Join(c.Var, "discovered.json")
+}
+
+// Use the repositories found by the last discovery (e.g. by an earlier run) until we discover them again
+func (c Configuration) LoadDiscovery() error {
+	if len(c.Discover) == 0 || c.discovered == nil {
+		return nil
+	}
+
+	blob, err := os.ReadFile(c.discoveryPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := []savedDiscovery{}
+	if err := json.Unmarshal(blob, &saved); err != nil {
+		return fmt.Errorf("Failed to read the last discovery %v: %v", c.discoveryPath(), err)
+	}
+	c.useDiscovery(saved)
+	return nil
+}
+
+// True once discovery has succeeded, so the repositories are known to be current
+func (c Configuration) DiscoveryCurrent() bool {
+	if len(c.Discover) == 0 || c.discovered == nil {
+		return true
+	}
+
+	c.discovered.lock.Lock()
+	defer c.discovered.lock.Unlock()
+	return !c.discovered.when.IsZero()
+}
+
+// Turn what was discovered into repositories, keeping those we already have so their state survives (e.g. tokens)
+func (c Configuration) useDiscovery(saved []savedDiscovery) {
+	blocks := map[string]DiscoveryConfiguration{}
+	for _, dc := range c.Discover {
+		blocks[dc.key()] = dc
+	}
+
+	c.discovered.lock.Lock()
+	defer c.discovered.lock.Unlock()
+
+	existing := map[string]RepositoryConfiguration{}
+	for _, rc := range c.discovered.repositories {
+		existing[rc.Identifier()] = rc
+	}
+
+	found := []RepositoryConfiguration{}
+	for _, sd := range saved {
+		dc, fnd := blocks[sd.Discovery]
+		if !fnd || !dc.Wanted(sd.Repository.Name) {
+			// the configuration has changed since
+			continue
+		}
+
+		rc := dc.repositoryFor(sd.Repository, sd.Repository.Branch)
+		if old, fnd := existing[rc.Identifier()]; fnd {
+			rc = old
+		}
+		found = append(found, rc)
+	}
+	c.discovered.repositories = found
+}
+
+// The configured repositories, followed by any discovered that aren't configured
+func (c Configuration) AllRepositories() []RepositoryConfiguration {
+	all := append([]RepositoryConfiguration{}, c.Repositories...)
+	if c.discovered == nil {
+		return all
+	}
+
+	seen := map[string]bool{}
+	for _, rc := range all {
+		seen[rc.Identifier()] = true
+	}
+
+	c.discovered.lock.Lock()
+	defer c.discovered.lock.Unlock()
+	for _, rc := range c.discovered.repositories {
+		if !seen[rc.Identifier()] {
+			seen[rc.Identifier()] = true
+			all = append(all, rc)
+		}
+	}
+	return all
+}
+
+func (gc *GithubConfiguration) forRepository(name string) *GithubConfiguration {
+	return &GithubConfiguration{
+		User:           gc.User,
+		Repository:     name,
+		StatusPat:      gc.StatusPat,
+		AppId:          gc.AppId,
+		InstallationId: gc.InstallationId,
+		PrivateKeyFile: gc.PrivateKeyFile,
+		PrivateKey:     gc.PrivateKey,
+	}
+}
+
+func (gc *GithubConfiguration) ListRepositories() ([]discoveredRepository, error) {
+	headers, err := gc.apiHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	type githubRepository struct {
+		Name          string
+		DefaultBranch string `json:"default_branch"`
+		Archived      bool
+		Owner         struct {
+			Login string
+		}
+	}
+
+	ret := []discoveredRepository{}
+	base := fmt.Sprintf("%v/orgs/%v/repos", githubApi, gc.User)
+	for page := 1; ; page++ {
+		listed := []githubRepository{}
+		url := fmt.Sprintf("%v?per_page=100&page=%v", base, page)
+		if gc.IsApp() {
+			// an installation sees only the repositories it was granted
+			reply := struct {
+				Repositories []githubRepository
+			}{}
+			url = fmt.Sprintf("%v/installation/repositories?per_page=100&page=%v", githubApi, page)
+			status, err := forgeGet(url, headers, &reply)
+			if err != nil {
+				return nil, err
+			}
+			if status != 200 {
+				return nil, fmt.Errorf("Github refused to list installation repositories (%v)", status)
+			}
+			listed = reply.Repositories
+		} else {
+			status, err := forgeGet(url, headers, &listed)
+			if err != nil {
+				return nil, err
+			}
+			if status == 404 && page == 1 && base != fmt.Sprintf("%v/users/%v/repos", githubApi, gc.User) {
+				// not an organisation, so try a user
+				base = fmt.Sprintf("%v/users/%v/repos", githubApi, gc.User)
+				page = 0
+				continue
+			}
+			if status != 200 {
+				return nil, fmt.Errorf("Github refused to list repositories for %v (%v)", gc.User, status)
+			}
+		}
+
+		for _, r := range listed {
+			if r.Archived || (r.Owner.Login != "" && !strings.EqualFold(r.Owner.Login, gc.User)) {
+				continue
+			}
+			ret = append(ret, discoveredRepository{Name: r.Name, DefaultBranch: r.DefaultBranch})
+		}
+		if len(listed) < 100 {
+			return ret, nil
+		}
+	}
+}
+
+func (gc *GithubConfiguration) HasFlake(dr discoveredRepository, branch string) (bool, error) {
+	headers, err := gc.apiHeaders()
+	if err != nil {
+		return false, err
+	}
+
+	u := fmt.Sprintf("%v/repos/%v/%v/contents/flake.nix?ref=%v", githubApi, gc.User, dr.Name, url.QueryEscape(branch))
+	status, err := forgeGet(u, headers, nil)
+	if err != nil {
+		return false, err
+	}
+	return status == 200, nil
+}
+
+func (fc *ForgejoConfiguration) ListRepositories() ([]discoveredRepository, error) {
+	type forgejoRepository struct {
+		Name          string
+		DefaultBranch string `json:"default_branch"`
+		Archived      bool
+		Empty         bool
+	}
+
+	ret := []discoveredRepository{}
+	base := fmt.Sprintf("%v://%v/api/v1/orgs/%v/repos", forgeScheme, fc.Domain, fc.User)
+	for page := 1; ; page++ {
+		listed := []forgejoRepository{}
+		status, err := forgeGet(fmt.Sprintf("%v?limit=50&page=%v", base, page), fc.apiHeaders(), &listed)
+		if err != nil {
+			return nil, err
+		}
+		if status == 404 && page == 1 && base != fmt.Sprintf("%v://%v/api/v1/users/%v/repos", forgeScheme, fc.Domain, fc.User) {
+			// not an organisation, so try a user
+			base = fmt.Sprintf("%v://%v/api/v1/users/%v/repos", forgeScheme, fc.Domain, fc.User)
+			page = 0
+			continue
+		}
+		if status != 200 {
+			return nil, fmt.Errorf("Forgejo refused to list repositories for %v (%v)", fc.User, status)
+		}
+
+		for _, r := range listed {
+			if r.Archived || r.Empty {
+				continue
+			}
+			ret = append(ret, discoveredRepository{Name: r.Name, DefaultBranch: r.DefaultBranch})
+		}
+		if len(listed) < 50 {
+			return ret, nil
+		}
+	}
+}
+
+func (fc *ForgejoConfiguration) HasFlake(dr discoveredRepository, branch string) (bool, error) {
+	u := fmt.Sprintf("%v://%v/api/v1/repos/%v/%v/contents/flake.nix?ref=%v", forgeScheme, fc.Domain, fc.User, dr.Name, url.QueryEscape(branch))
+	status, err := forgeGet(u, fc.apiHeaders(), nil)
+	if err != nil {
+		return false, err
+	}
+	return status == 200, nil
+}
+
+func (bc *BitbucketConfiguration) ListRepositories() ([]discoveredRepository, error) {
+	ret := []discoveredRepository{}
+	next := fmt.Sprintf("%v/repositories/%v?pagelen=100", bitbucketApi, bc.Workspace)
+	for next != "" {
+		reply := struct {
+			Values []struct {
+				Slug       string
+				Mainbranch *struct {
+					Name string
+				}
+			}
+			Next string
+		}{}
+		status, err := forgeGet(next, bc.apiHeaders(), &reply)
+		if err != nil {
+			return nil, err
+		}
+		if status != 200 {
+			return nil, fmt.Errorf("Bitbucket refused to list repositories for %v (%v)", bc.Workspace, status)
+		}
+
+		for _, r := range reply.Values {
+			dr := discoveredRepository{Name: r.Slug}
+			if r.Mainbranch != nil {
+				dr.DefaultBranch = r.Mainbranch.Name
+			}
+			ret = append(ret, dr)
+		}
+		next = reply.Next
+	}
+	return ret, nil
+}
+
+func (bc *BitbucketConfiguration) HasFlake(dr discoveredRepository, branch string) (bool, error) {
+	u := fmt.Sprintf("%v/repositories/%v/%v/src/%v/flake.nix", bitbucketApi, bc.Workspace, dr.Name, url.PathEscape(branch))
+	status, err := forgeGet(u, bc.apiHeaders(), nil)
+	if err != nil {
+		return false, err
+	}
+	return status == 200, nil
+}
+
+func (gd *GitlabDiscovery) apiHeaders() map[string]string {
+	headers := map[string]string{"Accept": "application/json"}
+	if gd.Token != "" {
+		headers["PRIVATE-TOKEN"] = gd.Token.Value()
+	}
+	return headers
+}
+
+func (gd *GitlabDiscovery) ListRepositories() ([]discoveredRepository, error) {
+	type gitlabProject struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+		SshUrlToRepo      string `json:"ssh_url_to_repo"`
+	}
+
+	ret := []discoveredRepository{}
+	for page := 1; ; page++ {
+		listed := []gitlabProject{}
+		u := fmt.Sprintf("%v://%v/api/v4/groups/%v/projects?include_subgroups=true&archived=false&per_page=100&page=%v", forgeScheme, gd.Domain, url.PathEscape(gd.Group), page)
+		status, err := forgeGet(u, gd.apiHeaders(), &listed)
+		if err != nil {
+			return nil, err
+		}
+		if status != 200 {
+			return nil, fmt.Errorf("GitLab refused to list projects for %v (%v)", gd.Group, status)
+		}
+
+		for _, p := range listed {
+			// names are relative to the group, so subgroups look like paths
+			name := p.PathWithNamespace
+			if len(name) > len(gd.Group)+1 && name[:len(gd.Group)+1] == gd.Group+"/" {
+				name = name[len(gd.Group)+1:]
+			}
+			ret = append(ret, discoveredRepository{Name: name, DefaultBranch: p.DefaultBranch, Remote: p.SshUrlToRepo})
+		}
+		if len(listed) < 100 {
+			return ret, nil
+		}
+	}
+}
+
+func (gd *GitlabDiscovery) HasFlake(dr discoveredRepository, branch string) (bool, error) {
+	project := url.PathEscape(gd.Group + "/" + dr.Name)
+	u := fmt.Sprintf("%v://%v/api/v4/projects/%v/repository/files/flake.nix?ref=%v", forgeScheme, gd.Domain, project, url.QueryEscape(branch))
+	status, err := forgeGet(u, gd.apiHeaders(), nil)
+	if err != nil {
+		return false, err
+	}
+	return status == 200, nil
+}
@@ -0,0 +1,110 @@
+/*
+discover_test.go - Tests of repository discovery
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+const githubDiscovery = `"discover": [{"repository": {"github": {"user": "owner", "statuspat": "pat"}}}],`
+
+func TestDiscoveryIsSavedForCommands(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	h.forge.SetRepositories([]string{"repo"}, false)
+
+	c := h.Configuration(githubDiscovery)
+	h.Tick(c)
+
+	// e.g. cix rebuild, while the forge can't list repositories
+	h.forge.SetRepositories(nil, true)
+	command := h.Configuration(githubDiscovery)
+	repo, err := command.FindRepository("owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Branch != "main" || repo.Github.Repository != "repo" {
+		t.Fatalf("found %+v", repo)
+	}
+
+	hash := remote.Commit("rebuilt")
+	if err := command.Rebuild(nil, "owner/repo", hash); err != nil {
+		t.Fatal(err)
+	}
+	if state := h.forge.LastState(hash); state != "success" {
+		t.Fatalf("status %v, expected success", state)
+	}
+}
+
+func TestRediscoveryKeepsRepositories(t *testing.T) {
+	h := newHarness(t)
+	h.newRemote("git@github.com:owner/repo")
+	h.forge.SetRepositories([]string{"repo"}, false)
+
+	c := h.Configuration(githubDiscovery)
+	if err := c.RefreshDiscovery(); err != nil {
+		t.Fatal(err)
+	}
+	before := c.AllRepositories()[0].Github
+
+	// due again
+	c.discovered.when = time.Time{}
+	if err := c.RefreshDiscovery(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same block, so its cached token and check runs survive
+	if after := c.AllRepositories()[0].Github; after != before {
+		t.Fatalf("rediscovery replaced the github block")
+	}
+}
+
+func TestOutboxSurvivesRestartWhileDiscoveryFails(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	h.forge.SetRepositories([]string{"repo"}, false)
+
+	c := h.Configuration(githubDiscovery)
+	h.Tick(c)
+
+	hash := remote.Commit("while the forge is down")
+	h.forge.FailNext(2)
+	h.Tick(c)
+	if size := c.OutboxSize(); size != 1 {
+		t.Fatalf("outbox has %v entries", size)
+	}
+
+	// restart with nothing saved from the last discovery, and the forge unable to list repositories
+	os.Remove(c.discoveryPath())
+	h.forge.SetRepositories(nil, true)
+	restarted := h.Configuration(githubDiscovery)
+	makeOutboxDue(t, restarted)
+	h.Tick(restarted)
+
+	if size := restarted.OutboxSize(); size != 1 {
+		t.Fatalf("outbox has %v entries, the status was dropped while discovery failed", size)
+	}
+
+	// discovery recovers, and the status is delivered
+	h.forge.SetRepositories([]string{"repo"}, false)
+	restarted.discovered.when = time.Time{}
+	h.Tick(restarted)
+
+	if state := h.forge.LastState(hash); state != "success" {
+		t.Fatalf("status %v, expected success", state)
+	}
+	if size := restarted.OutboxSize(); size != 0 {
+		t.Fatalf("outbox has %v entries after delivery", size)
+	}
+}
@@ -0,0 +1,412 @@
+/*
+forge.go - Shared tools for talking to code forges
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the forges' apis are, variables so the tests can use fakes
+var githubApi = "https://api.github.com"
+var bitbucketApi = "https://api.bitbucket.org/2.0"
+
+// For forges on their own domain (forgejo, gitlab)
+var forgeScheme = "https"
+
+// One client for every forge call, so connections are reused
+var forgeClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// Forge calls, and their waits for a rate limit, give up once this is done
+// Set from the shutdown, so a killed cix doesn't sit out a limit (its statuses wait in the outbox)
+var forgeContextLock sync.Mutex
+var forgeContextValue = context.Background()
+
+func setForgeContext(ctx context.Context) {
+	forgeContextLock.Lock()
+	defer forgeContextLock.Unlock()
+	forgeContextValue = ctx
+}
+
+func forgeContext() context.Context {
+	forgeContextLock.Lock()
+	defer forgeContextLock.Unlock()
+	return forgeContextValue
+}
+
+const (
+	// Spacing between calls to the same host
+	kForgeMinInterval = 100 * time.Millisecond
+
+	// Rather than wait longer than this for a rate limit, fail (e.g. a status goes to the outbox)
+	kForgeMaxWait = time.Minute
+
+	// Times to retry a call that was rate limited
+	kForgeRateLimitRetries = 3
+)
+
+// What we know of the rate limit for a credential on a host
+type forgeHost struct {
+	// Don't call before this
+	next time.Time
+
+	// Calls left before the limit resets, -1 if unknown
+	remaining int
+
+	reset time.Time
+}
+
+// Keyed by forgeLimitKey, as each token (or app installation) has its own limit
+var forgeHostsLock sync.Mutex
+var forgeHosts = map[string]*forgeHost{}
+
+// The host and a hash of the credential a request uses, so tokens for the same host don't share a limit
+func forgeLimitKey(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return r.URL.Host
+	}
+
+	digest := sha256.Sum256([]byte(authorization))
+	return r.URL.Host + "/" + hex.EncodeToString(digest[:8])
+}
+
+// How long to wait before calling with key, taking our place unless that is longer than kForgeMaxWait
+func forgeSlot(key string) time.Duration {
+	forgeHostsLock.Lock()
+	defer forgeHostsLock.Unlock()
+
+	fh, fnd := forgeHosts[key]
+	if !fnd {
+		fh = &forgeHost{remaining: -1}
+		forgeHosts[key] = fh
+	}
+
+	now := time.Now()
+	start := now
+	if fh.next.After(start) {
+		start = fh.next
+	}
+
+	interval := kForgeMinInterval
+	if fh.remaining >= 0 && fh.reset.After(start) {
+		if fh.remaining == 0 {
+			// nothing left until the reset
+			start = fh.reset
+		} else if spread := time.Until(fh.reset) / time.Duration(fh.remaining); spread > interval {
+			// running low, so spread what is left over the time to the reset
+			interval = spread
+		}
+	}
+
+	if start.Sub(now) > kForgeMaxWait {
+		return start.Sub(now)
+	}
+
+	fh.next = start.Add(interval)
+	if fh.remaining > 0 {
+		fh.remaining -= 1
+	}
+	return start.Sub(now)
+}
+
+// Parse a Retry-After, which is seconds or a date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when), true
+	}
+	return 0, false
+}
+
+// github, forgejo and bitbucket use X-RateLimit-*, gitlab RateLimit-*
+var kRateLimitPrefixes = []string{"X-RateLimit-", "RateLimit-"}
+
+// The calls left before the limit resets, -1 if the reply doesn't say
+func forgeRemaining(res *http.Response) int {
+	for _, prefix := range kRateLimitPrefixes {
+		if remaining, err := strconv.Atoi(res.Header.Get(prefix + "Remaining")); err == nil {
+			return remaining
+		}
+	}
+	return -1
+}
+
+// Github's secondary rate limits are a 403 with only a message to say so
+var forgeRateLimitRe = regexp.MustCompile(`(?i)rate limit`)
+
+// True if a reply is the forge limiting our rate rather than refusing the call
+// Github uses 403 for both, so one with no calls left, a Retry-After or a message saying so is a limit
+func forgeLimitedReply(res *http.Response, remaining int, message string) bool {
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+
+	case http.StatusForbidden:
+		return remaining == 0 || res.Header.Get("Retry-After") != "" || forgeRateLimitRe.MatchString(message)
+	}
+	return false
+}
+
+// The message of a 403, leaving the body to be read again
+func forgePeekMessage(res *http.Response) string {
+	if res.StatusCode != http.StatusForbidden {
+		return ""
+	}
+
+	blob, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(blob), res.Body), res.Body}
+	return forgeErrorMessage(blob)
+}
+
+// Note the rate limit headers of a reply, returning how long to back off if we were limited
+func forgeNoteLimits(key string, res *http.Response) (time.Duration, bool) {
+	message := forgePeekMessage(res)
+
+	forgeHostsLock.Lock()
+	defer forgeHostsLock.Unlock()
+
+	fh := forgeHosts[key]
+	if fh == nil {
+		fh = &forgeHost{remaining: -1}
+		forgeHosts[key] = fh
+	}
+
+	if remaining := forgeRemaining(res); remaining >= 0 {
+		fh.remaining = remaining
+	}
+	for _, prefix := range kRateLimitPrefixes {
+		if reset, err := strconv.ParseInt(res.Header.Get(prefix+"Reset"), 10, 64); err == nil {
+			fh.reset = time.Unix(reset, 0)
+		}
+	}
+
+	if !forgeLimitedReply(res, fh.remaining, message) {
+		return 0, false
+	}
+
+	wait := time.Until(fh.reset)
+	if after, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+		wait = after
+	}
+	if wait < time.Second {
+		// limited, but with no idea for how long
+		wait = 10 * time.Second
+	}
+
+	fh.next = time.Now().Add(wait)
+	return wait, true
+}
+
+// Make a call to a forge with the shared client, waiting our turn and backing off when rate limited
+// The waits end early, with an error, when the request's context is done
+// The caller closes the body of the reply
+func forgeDo(r *http.Request) (*http.Response, error) {
+	host := r.URL.Host
+	key := forgeLimitKey(r)
+	ctx := r.Context()
+
+	for attempt := 0; ; attempt++ {
+		wait := forgeSlot(key)
+		if wait > kForgeMaxWait {
+			return nil, fmt.Errorf("Rate limited by %v for another %v", host, wait.Round(time.Second))
+		}
+		if wait > time.Second {
+			fmt.Println("Waiting ", wait.Round(time.Second), " for the ", host, " rate limit")
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
+
+		if attempt > 0 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		res, err := forgeClient.Do(r)
+		if err != nil {
+			return nil, err
+		}
+
+		backoff, limited := forgeNoteLimits(key, res)
+		// a body we can't rewind can't be sent again
+		if !limited || attempt >= kForgeRateLimitRetries || (r.Body != nil && r.GetBody == nil) {
+			return res, nil
+		}
+
+		res.Body.Close()
+		if backoff > kForgeMaxWait {
+			return nil, fmt.Errorf("Rate limited by %v for another %v", host, backoff.Round(time.Second))
+		}
+	}
+}
+
+// A forge replied with something other than success
+type ForgeError struct {
+	Method string
+	Url    string
+
+	StatusCode int
+
+	// The forge's explanation, if it gave one
+	Message string
+
+	// The forge was limiting our rate, rather than refusing the call
+	RateLimited bool
+}
+
+func (fe *ForgeError) Error() string {
+	if fe.Message == "" {
+		return fmt.Sprintf("%v %v failed (%v)", fe.Method, fe.Url, fe.StatusCode)
+	}
+	return fmt.Sprintf("%v %v failed (%v): %v", fe.Method, fe.Url, fe.StatusCode, fe.Message)
+}
+
+// True if the same call may work later
+func (fe *ForgeError) Temporary() bool {
+	return fe.StatusCode >= 500 || fe.StatusCode == http.StatusRequestTimeout || fe.StatusCode == http.StatusTooManyRequests || fe.RateLimited
+}
+
+// True if the error is a forge refusing the call, so there is no point retrying it
+func permanentError(err error) bool {
+	var fe *ForgeError
+	return errors.As(err, &fe) && !fe.Temporary()
+}
+
+// Pick the message out of a forge's error reply
+func forgeErrorMessage(body []byte) string {
+	// github & forgejo use {"message": ...}, bitbucket {"error": {"message": ...}}
+	reply := struct {
+		Message string
+		Error   struct {
+			Message string
+		}
+	}{}
+	if err := json.Unmarshal(body, &reply); err == nil {
+		if reply.Message != "" {
+			return reply.Message
+		}
+		if reply.Error.Message != "" {
+			return reply.Error.Message
+		}
+	}
+
+	message := strings.TrimSpace(string(body))
+	if len(message) > 200 {
+		message = message[:200] + "..."
+	}
+	return message
+}
+
+// Call a forge api, sending body (if not nil) as json and decoding the reply into into (if not nil)
+// A reply other than 2xx is returned as a *ForgeError
+func forgeCall(method, url string, headers map[string]string, body, into interface{}) error {
+	var content io.Reader
+	if body != nil {
+		blob, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("Failed to encode %v %v: %v", method, url, err)
+		}
+		content = bytes.NewReader(blob)
+	}
+
+	r, err := http.NewRequestWithContext(forgeContext(), method, url, content)
+	if err != nil {
+		return fmt.Errorf("Failed to start %v %v: %v", method, url, err)
+	}
+	for k, v := range headers {
+		r.Header.Add(k, v)
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := forgeDo(r)
+	if err != nil {
+		return fmt.Errorf("Error calling %v: %w", url, err)
+	}
+
+	reply, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Error reading reply from %v: %v", url, err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		message := forgeErrorMessage(reply)
+		limited := forgeLimitedReply(res, forgeRemaining(res), message)
+		return &ForgeError{Method: method, Url: url, StatusCode: res.StatusCode, Message: message, RateLimited: limited}
+	}
+
+	if into == nil {
+		return nil
+	}
+	if err := json.Unmarshal(reply, into); err != nil {
+		return fmt.Errorf("Bad reply from %v: %v", url, err)
+	}
+	return nil
+}
+
+// Get json from a forge api, returning the status code
+// Only a failure to make the call is an error, so the caller can decide what a 404 means
+func forgeGet(url string, headers map[string]string, into interface{}) (int, error) {
+	return forgeStatusCode(forgeCall("GET", url, headers, nil, into))
+}
+
+// The status code of a call's error, only returning an error if the call wasn't made
+func forgeStatusCode(err error) (int, error) {
+	var fe *ForgeError
+	if errors.As(err, &fe) {
+		return fe.StatusCode, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return http.StatusOK, nil
+}
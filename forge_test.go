@@ -0,0 +1,225 @@
+/*
+forge_test.go - Tests of calls to the forges
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForgeLimitedReply(t *testing.T) {
+	cases := []struct {
+		status    int
+		header    string
+		remaining int
+		message   string
+		limited   bool
+	}{
+		{http.StatusTooManyRequests, "", -1, "", true},
+		{http.StatusForbidden, "", 0, "", true},
+		{http.StatusForbidden, "60", -1, "", true},
+		{http.StatusForbidden, "", -1, "You have exceeded a secondary rate limit", true},
+		{http.StatusForbidden, "", -1, "API rate limit exceeded for installation", true},
+
+		// refused, retrying won't help
+		{http.StatusForbidden, "", 10, "Resource not accessible by integration", false},
+		{http.StatusForbidden, "", -1, "", false},
+		{http.StatusUnauthorized, "", -1, "Bad credentials", false},
+		{http.StatusNotFound, "", -1, "Not Found", false},
+	}
+
+	for _, tc := range cases {
+		res := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+		if tc.header != "" {
+			res.Header.Set("Retry-After", tc.header)
+		}
+		if limited := forgeLimitedReply(res, tc.remaining, tc.message); limited != tc.limited {
+			t.Errorf("%+v was limited %v", tc, limited)
+		}
+	}
+}
+
+func TestForgeRetriesRateLimited403(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls += 1
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"message":"You have exceeded a secondary rate limit"}`, http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"done": true}`))
+	}))
+	defer server.Close()
+
+	reply := struct {
+		Done bool
+	}{}
+	if err := forgeCall("POST", server.URL+"/statuses", nil, map[string]string{"state": "success"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Done || calls != 2 {
+		t.Errorf("Expected a second call to succeed, made %v, reply %+v", calls, reply)
+	}
+}
+
+func TestForgeErrorTemporary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/refused") {
+			http.Error(w, `{"message":"Resource not accessible by integration"}`, http.StatusForbidden)
+			return
+		}
+		// still limited once the retries are used up
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, `{"message":"API rate limit exceeded"}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	if err := forgeCall("GET", server.URL+"/refused", nil, nil, nil); !permanentError(err) {
+		t.Errorf("Expected a refusal to be permanent, got %v", err)
+	}
+	if err := forgeCall("GET", server.URL+"/limited", nil, nil, nil); err == nil || permanentError(err) {
+		t.Errorf("Expected a rate limit to be temporary, got %v", err)
+	}
+}
+
+// An app whose cached token github no longer accepts
+func TestGithubAppRefreshesRefusedToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	var lock sync.Mutex
+	issued, refused, posted := 0, 0, 0
+	issue := "fresh"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if strings.HasSuffix(r.URL.Path, "/access_tokens") {
+			issued += 1
+			fmt.Fprintf(w, `{"token": %q, "expires_at": %q}`, issue, time.Now().Add(time.Hour).Format(time.RFC3339))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			refused += 1
+			http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		posted += 1
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	oldGithub := githubApi
+	githubApi = server.URL
+	t.Cleanup(func() { githubApi = oldGithub })
+
+	gc := &GithubConfiguration{
+		User:           "owner",
+		Repository:     "repo",
+		AppId:          1,
+		InstallationId: 2,
+		PrivateKey:     Secret(pemKey),
+		token:          "revoked",
+		tokenExpiry:    time.Now().Add(time.Hour),
+	}
+
+	if err := gc.SetStatus(KSucceeded, "cix", "", strings.Repeat("a", 40)); err != nil {
+		t.Fatal(err)
+	}
+	if refused != 1 || issued != 1 || posted != 1 {
+		t.Errorf("Expected one refusal, one new token and one status, got %v, %v and %v", refused, issued, posted)
+	}
+
+	// a token github refuses outright isn't retried forever
+	gc.token, gc.tokenExpiry = "revoked", time.Now().Add(time.Hour)
+	lock.Lock()
+	issue = "also-refused"
+	lock.Unlock()
+	if err := gc.SetStatus(KSucceeded, "cix", "", strings.Repeat("a", 40)); !permanentError(err) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+	if refused != 3 || issued != 2 {
+		t.Errorf("Expected a single retry, got %v refusals and %v tokens", refused, issued)
+	}
+}
+
+func TestForgeWaitEndsWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, `{"message":"slow down"}`, http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	setForgeContext(ctx)
+	t.Cleanup(func() { setForgeContext(context.Background()) })
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := forgeCall("GET", server.URL+"/limited", nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the wait to be cancelled, got %v", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("Waited %v for a cancelled call", waited)
+	}
+}
+
+func TestForgeLimitsArePerCredential(t *testing.T) {
+	reset := fmt.Sprint(time.Now().Add(time.Hour).Unix())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer spent" {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", reset)
+			http.Error(w, `{"message":"API rate limit exceeded"}`, http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	spent := map[string]string{"Authorization": "Bearer spent"}
+	if err := forgeCall("GET", server.URL+"/a", spent, nil, nil); err == nil || permanentError(err) {
+		t.Errorf("Expected the spent token to be rate limited, got %v", err)
+	}
+	if err := forgeCall("GET", server.URL+"/b", spent, nil, nil); err == nil || permanentError(err) {
+		t.Errorf("Expected the spent token to still be rate limited, got %v", err)
+	}
+
+	// another token for the same host has its own limit
+	start := time.Now()
+	if err := forgeCall("GET", server.URL+"/c", map[string]string{"Authorization": "Bearer fresh"}, nil, nil); err != nil {
+		t.Errorf("Expected another token to work, got %v", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("Another token waited %v", waited)
+	}
+}
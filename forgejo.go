@@ -2,16 +2,13 @@ package main
 
 import (
 	"fmt"
-	"net/http"
-	"bytes"
-	"io"
 )
 
 type ForgejoConfiguration struct {
 	Domain string
 	User string
 	Repository string
-	Token string
+	Token Secret
 	Ssh bool
 }
 
@@ -22,52 +19,41 @@ func (fc *ForgejoConfiguration) Valid() bool {
 	return fc.Domain != "" && fc.User != "" && fc.Repository != ""
 }
 
+type forgejoStatus struct {
+	State       string `json:"state"`
+	Context     string `json:"context"`
+	Description string `json:"description"`
+}
+
 func (fc *ForgejoConfiguration)	SetStatus(status CiStatus, comment, description, hash string) error {
 	if fc.Token == "" {
 		return nil
 	}
-	url := fmt.Sprintf("https://%v/api/v1/repos/%v/%v/statuses/%v", fc.Domain, fc.User, fc.Repository, hash)
+	url := fmt.Sprintf("%v://%v/api/v1/repos/%v/%v/statuses/%v", forgeScheme, fc.Domain, fc.User, fc.Repository, hash)
 
-	forgejoStatus := "error"
+	state := "error"
 	switch status {
 		case KInProgress:
-			forgejoStatus = "pending"
+			state = "pending"
 		case KFailed:
-			forgejoStatus = "failure"
+			state = "failure"
 		case KError:
-			forgejoStatus = "error"
+			state = "error"
 		case KSucceeded:
-			forgejoStatus = "success"
+			state = "success"
+		case KSkipped, KSuperseded:
+			state = "warning"
 	}
 
 	if len(description) > 255 {
 		description = description[:253] + "..."
 	}
 
-	body := []byte(fmt.Sprintf(`{"state":"%s","context": "%s","description":"%s"}`, forgejoStatus, comment, description))
-
-	r, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return fmt.Errorf("Failed to start post: %v", err)
-	}
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", fmt.Sprintf("token %s", fc.Token))
-
-	client := &http.Client{}
-	res, err := client.Do(r)
-	if err != nil {
-		return fmt.Errorf("Error posting forgejo status: %v", err)
+	body := forgejoStatus{State: state, Context: comment, Description: description}
+	if err := forgeCall("POST", url, fc.apiHeaders(), body, nil); err != nil {
+		return fmt.Errorf("Error posting forgejo status: %w", err)
 	}
-
-	body, _ = io.ReadAll(res.Body)
-
-	res.Body.Close()
-
-	if res.StatusCode != 200 && res.StatusCode != 201 {
-		fmt.Println(res.StatusCode)
-		fmt.Println(string(body))
-	}
-	return nil	
+	return nil
 }
 
 func (fc *ForgejoConfiguration)	NixUrl(revision string) string {
@@ -83,3 +69,39 @@ func (fc *ForgejoConfiguration) GitUrl() string {
 	}
 	return fmt.Sprintf("git@%s:%s/%s.git", fc.Domain, fc.User, fc.Repository)
 }
+
+func (fc *ForgejoConfiguration) apiHeaders() map[string]string {
+	headers := map[string]string{"Accept": "application/json"}
+	if fc.Token != "" {
+		headers["Authorization"] = fmt.Sprintf("token %s", fc.Token.Value())
+	}
+	return headers
+}
+
+var _ StatusReader = &ForgejoConfiguration{}
+
+func (fc *ForgejoConfiguration) HasStatus(comment, hash string) (bool, error) {
+	if fc.Token == "" {
+		// we can't have posted one
+		return false, nil
+	}
+
+	statuses := []struct {
+		Context string
+	}{}
+	url := fmt.Sprintf("%v://%v/api/v1/repos/%v/%v/commits/%v/statuses?limit=50", forgeScheme, fc.Domain, fc.User, fc.Repository, hash)
+	status, err := forgeGet(url, fc.apiHeaders(), &statuses)
+	if err != nil {
+		return false, err
+	}
+	if status != 200 {
+		return false, fmt.Errorf("Forgejo refused to list statuses for %v (%v)", hash, status)
+	}
+
+	for _, s := range statuses {
+		if s.Context == comment {
+			return true, nil
+		}
+	}
+	return false, nil
+}
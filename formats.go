@@ -0,0 +1,77 @@
+/*
+formats.go - Configuration file formats for Cix
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Evaluate a nix expression to json
+// This uses nix from the path, as we can't know the configured NixPath until we've read the config
+func nixEvalJson(file string, args ...string) ([]byte, error) {
+	cmd := exec.Command("nix", append([]string{"eval", "--json"}, args...)...)
+	cmd.Env = append(os.Environ(), "CIX_CONFIG="+file)
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	blob, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to evaluate %v with nix: %v\n%v", file, err, strings.TrimSpace(stderr.String()))
+	}
+	return blob, nil
+}
+
+// Read a configuration file as json, converting from other formats by extension
+// The bool is true if positions in the json match positions in the file
+func readConfigurationJson(file string) ([]byte, bool, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		// nix can already read toml
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, false, err
+		}
+		blob, err := nixEvalJson(abs, "--impure", "--expr", `builtins.fromTOML (builtins.readFile (builtins.getEnv "CIX_CONFIG"))`)
+		return blob, false, err
+
+	case ".nix":
+		blob, err := nixEvalJson(file, "--impure", "--file", file)
+		return blob, false, err
+
+	case ".yaml", ".yml":
+		blob, err := os.ReadFile(file)
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed to read config at %v", file)
+		}
+		blob, err = YamlToJson(blob)
+		var ye *yamlError
+		if errors.As(err, &ye) {
+			return nil, false, ConfigErrors{{File: file, Line: ye.Line, Column: ye.Column, Message: ye.Message}}
+		}
+		if err != nil {
+			return nil, false, ConfigErrors{{File: file, Message: err.Error()}}
+		}
+		return blob, false, nil
+	}
+
+	blob, err := os.ReadFile(file)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to read config at %v", file)
+	}
+	return blob, true, nil
+}
@@ -19,6 +19,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Check if a commit is (likely) valid
@@ -31,10 +32,60 @@ func VerifyCommit(s string) bool {
 	return true
 }
 
+// Check a revision from a user (a hash, branch, tag, ...) can't be taken for an option by git
+func ValidRevision(revision string) bool {
+	return revision != "" && !strings.HasPrefix(revision, "-")
+}
+
+// Check a branch name is one git would accept
+// This follows the rules of git check-ref-format --branch
+func ValidBranchName(name string) bool {
+	if name == "" || name == "@" || strings.HasPrefix(name, "-") {
+		return false
+	}
+
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") {
+		return false
+	}
+
+	for _, bad := range []string{"..", "//", "@{", "/."} {
+		if strings.Contains(name, bad) {
+			return false
+		}
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return false
+		}
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Main repo object
 // TODO add branch as we only keep a single branch per repo
 type Repository struct {
 	Path string
+
+	// Extra environment for git commands (e.g. GIT_SSH_COMMAND)
+	Env []string
+}
+
+// A git command to run in this repository
+func (r Repository) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.Path
+	if len(r.Env) > 0 {
+		cmd.Env = append(os.Environ(), r.Env...)
+	}
+	return cmd
 }
 
 // Check for existence
@@ -59,10 +110,9 @@ func (r Repository) CheckoutTo(path, branch string) error {
 	return nil
 }
 
-// Return a set of all commits in the repository
-func (r Repository) ListCommits(branch string) (map[string]bool, error) {
-	cmd := exec.Command("git", "rev-list", branch)
-	cmd.Dir = r.Path
+// Return all commits on a branch, newest first with children always before their parents
+func (r Repository) ListCommits(branch string) ([]string, error) {
+	cmd := r.command("rev-list", "--topo-order", branch)
 
 	so, err := cmd.StdoutPipe()
 	if err != nil {
@@ -78,7 +128,7 @@ func (r Repository) ListCommits(branch string) (map[string]bool, error) {
 		return nil, fmt.Errorf("Failed running git command to list commits")
 	}
 
-	ret := map[string]bool{}
+	ret := []string{}
 	hashes := strings.Split(string(slurp), "\n")
 	for _, hash := range hashes {
 		if hash == "" {
@@ -88,15 +138,150 @@ func (r Repository) ListCommits(branch string) (map[string]bool, error) {
 		if !VerifyCommit(hash) {
 			return nil, fmt.Errorf("Did not understand hash: '%v'", hash)
 		}
-		ret[hash] = true
+		ret = append(ret, hash)
 	}
 	return ret, nil
 }
 
+// The full hash of a revision (a hash, branch, tag, ...)
+func (r Repository) ResolveRevision(revision string) (string, error) {
+	cmd := r.command("rev-parse", "--verify", "--quiet", "--end-of-options", revision+"^{commit}")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Unknown revision %v in %v", revision, r.Path)
+	}
+
+	hash := strings.TrimSpace(string(out))
+	if !VerifyCommit(hash) {
+		return "", fmt.Errorf("Did not understand hash: '%v'", hash)
+	}
+	return hash, nil
+}
+
+// Fetch a revision that may not be on our branch, and return its hash
+// Falls back to what we have locally if the remote won't give it to us (e.g. a hash it won't serve)
+func (r Repository) FetchRevision(revision string) (string, error) {
+	if VerifyCommit(revision) {
+		if hash, err := r.ResolveRevision(revision); err == nil {
+			return hash, nil
+		}
+	}
+
+	cmd := r.command("fetch", "origin", "--end-of-options", revision)
+	if err := cmd.Run(); err != nil {
+		return r.ResolveRevision(revision)
+	}
+	return r.ResolveRevision("FETCH_HEAD")
+}
+
+// Commits on a branch, newest first with children always before their parents
+// Limited to count commits (if not 0), and to those after since (if not ""), which is a date or a revision
+func (r Repository) ListRecentCommits(branch string, count int, since string) ([]string, error) {
+	args := []string{"rev-list", "--topo-order"}
+	if count > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%v", count))
+	}
+
+	args = append(args, branch)
+	if since != "" {
+		if _, err := time.Parse("2006-01-02", since); err == nil {
+			args = append(args, "--since="+since)
+		} else if _, err := time.Parse(time.RFC3339, since); err == nil {
+			args = append(args, "--since="+since)
+		} else {
+			hash, err := r.ResolveRevision(since)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "^"+hash)
+		}
+	}
+
+	out, err := r.command(args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed running git command to list commits")
+	}
+
+	hashes := []string{}
+	for _, hash := range strings.Split(string(out), "\n") {
+		if hash == "" {
+			continue
+		}
+		if !VerifyCommit(hash) {
+			return nil, fmt.Errorf("Did not understand hash: '%v'", hash)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Commits following only first parents, newest first, back to (but not including) since if it is not ""
+func (r Repository) FirstParentCommits(branch, since string) ([]string, error) {
+	args := []string{"rev-list", "--first-parent", branch}
+	if since != "" {
+		args = append(args, "^"+since)
+	}
+
+	out, err := r.command(args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed running git command to list commits")
+	}
+
+	hashes := []string{}
+	for _, hash := range strings.Split(string(out), "\n") {
+		if hash == "" {
+			continue
+		}
+		if !VerifyCommit(hash) {
+			return nil, fmt.Errorf("Did not understand hash: '%v'", hash)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// The commit half way between a bad commit and some good ones, "" if there is nothing left between them
+func (r Repository) BisectMidpoint(bad string, good []string) (string, error) {
+	args := []string{"rev-list", "--bisect", bad}
+	for _, hash := range good {
+		args = append(args, "^"+hash)
+	}
+
+	out, err := r.command(args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed running git command to bisect")
+	}
+
+	hash := strings.TrimSpace(string(out))
+	if hash == "" || hash == bad {
+		return "", nil
+	}
+	if !VerifyCommit(hash) {
+		return "", fmt.Errorf("Did not understand hash: '%v'", hash)
+	}
+	return hash, nil
+}
+
+// The hash at the tip of the branch on the remote, without fetching it
+func (r Repository) RemoteTip(branch string) (string, error) {
+	out, err := r.command("ls-remote", "origin", "refs/heads/"+branch).Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to list the remote branch %v of %v", branch, r.Path)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("No branch %v on the remote of %v", branch, r.Path)
+	}
+	if !VerifyCommit(fields[0]) {
+		return "", fmt.Errorf("Did not understand hash: '%v'", fields[0])
+	}
+	return fields[0], nil
+}
+
 // Fetch all new commits
 func (r Repository) Fetch(branch string) error {
-	cmd := exec.Command("git", "fetch", "origin", branch+":"+branch)
-	cmd.Dir = r.Path
+	cmd := r.command("fetch", "origin", branch+":"+branch)
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("Fetch failed for %v / %v", r.Path, branch)
@@ -105,6 +290,63 @@ func (r Repository) Fetch(branch string) error {
 	return nil
 }
 
+// Fetch the tip of a branch into one of our own refs, leaving the local branch where it is, and return its hash
+// So commits fetched this way are still new to the next tick
+func (r Repository) FetchBranchTo(branch, ref string) (string, error) {
+	cmd := r.command("fetch", "origin", "+refs/heads/"+branch+":"+ref)
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Fetch failed for %v / %v", r.Path, branch)
+	}
+
+	return r.ResolveRevision(ref)
+}
+
+// Where we record the last tip of a branch that passed its tests
+func passedRef(branch string) string {
+	return "refs/cix/passed/" + branch
+}
+
+// Record that hash passed, if it is the tip of branch, so the next tests of the branch can bisect from it
+func (r Repository) NotePassed(branch, hash string) error {
+	tip, err := r.ResolveRevision(branch)
+	if err != nil || tip != hash {
+		return err
+	}
+
+	if err := r.command("update-ref", passedRef(branch), hash).Run(); err != nil {
+		return fmt.Errorf("Failed to record %v passing in %v", hash, r.Path)
+	}
+	return nil
+}
+
+// The last tip of branch that passed, "" if none has
+func (r Repository) PassedTip(branch string) string {
+	hash, err := r.ResolveRevision(passedRef(branch))
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// Where we record a commit we deliberately didn't test
+func skippedRef(hash string) string {
+	return "refs/cix/skipped/" + hash
+}
+
+// Record that a commit was skipped
+func (r Repository) NoteSkipped(hash string) error {
+	if err := r.command("update-ref", skippedRef(hash), hash).Run(); err != nil {
+		return fmt.Errorf("Failed to record %v as skipped in %v", hash, r.Path)
+	}
+	return nil
+}
+
+// True if we recorded the commit as skipped
+func (r Repository) WasSkipped(hash string) bool {
+	return r.command("rev-parse", "--verify", "--quiet", skippedRef(hash)).Run() == nil
+}
+
 // Clone a new repo
 func (r Repository) Clone(remote, branch string) error {
 	// TODO ideally we'd clone to a temporary working path
@@ -112,7 +354,7 @@ func (r Repository) Clone(remote, branch string) error {
 	parent := filepath.Dir(r.Path)
 	os.MkdirAll(parent, 0777)
 
-	cmd := exec.Command("git", "clone", "--bare", "-b", branch, remote, name)
+	cmd := r.command("clone", "--bare", "-b", branch, remote, name)
 	cmd.Dir = parent
 	so, err := cmd.StderrPipe()
 	if err != nil {
@@ -0,0 +1,53 @@
+/*
+git_test.go - Tests of the git wrappers
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidRevision(t *testing.T) {
+	for revision, valid := range map[string]bool{
+		"main":                     true,
+		"v1.2":                     true,
+		"HEAD~2":                   true,
+		"2024-01-02":               true,
+		"":                         false,
+		"-v":                       false,
+		"--upload-pack=touch /tmp": false,
+	} {
+		if ValidRevision(revision) != valid {
+			t.Errorf("%q valid %v, expected %v", revision, !valid, valid)
+		}
+	}
+}
+
+// Even without the checks in front of it, git mustn't take a revision for an option
+func TestRebuildRevisionIsntAnOption(t *testing.T) {
+	h := newHarness(t)
+	h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+
+	marker := filepath.Join(h.dir, "uploaded")
+	if err := c.Rebuild(nil, "owner/repo", "--upload-pack=touch "+marker); err == nil {
+		t.Errorf("rebuilt an option")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("git ran the upload pack")
+	}
+	if tested := h.Tested(); len(tested) != 0 {
+		t.Errorf("tested %v", tested)
+	}
+}
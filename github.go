@@ -12,28 +12,80 @@ THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR I
 package main
 
 import (
-	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
 )
 
 type GithubConfiguration struct {
 	User       string
 	Repository string
-	StatusPat  string
+	StatusPat  Secret
+
+	// (optional) Github App authentication, used in preference to StatusPat
+	AppId          int64
+	InstallationId int64
+	PrivateKeyFile string
+
+	// (optional) The app's private key itself, as an alternative to PrivateKeyFile
+	PrivateKey Secret
+
+	// guards the cached installation token and check runs
+	lock        sync.Mutex
+	token       string
+	tokenExpiry time.Time
+
+	// check runs in progress, keyed by context/hash
+	checkRuns map[string]int64
 }
 
 var _ RepoSource = &GithubConfiguration{}
+var _ GitEnvSource = &GithubConfiguration{}
 
 func (gc *GithubConfiguration) NixUrl(revision string) string {
 	return fmt.Sprintf("github:%v/%v?rev=%v", gc.User, gc.Repository, revision)
 }
 
 func (gc *GithubConfiguration) GitUrl() string {
+	if gc.IsApp() {
+		// the installation token only works over https
+		return fmt.Sprintf("https://github.com/%v/%v.git", gc.User, gc.Repository)
+	}
 	return fmt.Sprintf("git@github.com:%v/%v", gc.User, gc.Repository)
 }
 
+func (gc *GithubConfiguration) GitEnv() ([]string, error) {
+	if !gc.IsApp() {
+		return nil, nil
+	}
+
+	token, err := gc.InstallationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// passed as config in the environment so the token never lands in .git/config or a process list
+	basic := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.https://github.com/.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + basic,
+	}, nil
+}
+
+// The token to use with the api, "" if we have none
+func (gc *GithubConfiguration) apiToken() (string, error) {
+	if gc.IsApp() {
+		return gc.InstallationToken()
+	}
+
+	return gc.StatusPat.Value(), nil
+}
+
 func (gc *GithubConfiguration) Valid() bool {
 	if gc == nil {
 		return false
@@ -42,11 +94,26 @@ func (gc *GithubConfiguration) Valid() bool {
 	return gc.User != "" && gc.Repository != ""
 }
 
+type githubStatus struct {
+	State       string `json:"state"`
+	Context     string `json:"context"`
+	Description string `json:"description"`
+}
+
 func (gc *GithubConfiguration) SetStatus(status CiStatus, comment, description, hash string) error {
-	if gc.StatusPat == "" {
+	token, err := gc.apiToken()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return nil
+	}
+	url := fmt.Sprintf("%v/repos/%v/%v/statuses/%v", githubApi, gc.User, gc.Repository, hash)
+
+	if status == KSkipped {
+		// no neutral state, see StatusReader
 		return nil
 	}
-	url := fmt.Sprintf("https://api.github.com/repos/%v/%v/statuses/%v", gc.User, gc.Repository, hash)
 
 	st := "error"
 	switch status {
@@ -61,39 +128,114 @@ func (gc *GithubConfiguration) SetStatus(status CiStatus, comment, description,
 
 	case KSucceeded:
 		st = "success"
+
+	case KSuperseded:
+		// statuses have no neutral state, and this may have been killed half way, the description says why
+		st = "error"
 	}
 
 	if len(description) > 140 {
 		description = description[:136] + "..."
 	}
 
-	// our descriptions are too long, so we ignore them
-	body := []byte(fmt.Sprintf(`{"state":"%v","context":"%v", "description": "%v"}`, st, comment, description))
-
-	r, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	err = gc.apiCall("POST", url, githubStatus{State: st, Context: comment, Description: description}, nil)
 	if err != nil {
-		return fmt.Errorf("Failed to start post: %v", err)
+		return fmt.Errorf("Error posting github status: %w", err)
 	}
-	r.Header.Add("Accept", "application/vnd.github+json")
-	r.Header.Add("X-GitHub-Api-Version", "2022-11-28")
-	r.Header.Add("Authorization", fmt.Sprintf("Bearer %v", gc.StatusPat))
+	return nil
+}
 
-	client := &http.Client{}
-	res, err := client.Do(r)
+func (gc *GithubConfiguration) apiHeaders() (map[string]string, error) {
+	headers := map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+
+	token, err := gc.apiToken()
 	if err != nil {
-		return fmt.Errorf("Error posting github status: %v", err)
+		return nil, err
+	}
+	if token != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %v", token)
 	}
+	return headers, nil
+}
 
-	body, _ = io.ReadAll(res.Body)
+// Call the api with our headers, as an app getting a new token and trying once more if github refuses the cached one
+func (gc *GithubConfiguration) apiCall(method, url string, body, into interface{}) error {
+	for attempt := 0; ; attempt++ {
+		headers, err := gc.apiHeaders()
+		if err != nil {
+			return err
+		}
+
+		err = forgeCall(method, url, headers, body, into)
+		var fe *ForgeError
+		if attempt == 0 && gc.IsApp() && errors.As(err, &fe) && fe.StatusCode == http.StatusUnauthorized {
+			// revoked, or the app's key was rotated
+			gc.forgetToken(headers["Authorization"])
+			continue
+		}
+		return err
+	}
+}
+
+// Get json from the api with apiCall, returning the status code like forgeGet
+func (gc *GithubConfiguration) apiGet(url string, into interface{}) (int, error) {
+	return forgeStatusCode(gc.apiCall("GET", url, nil, into))
+}
 
-	res.Body.Close()
-	switch res.StatusCode {
-	case 200, 201:
-		// ok
+var _ StatusReader = &GithubConfiguration{}
 
-	default:
-		fmt.Println(res.StatusCode)
-		fmt.Println(string(body))
+func (gc *GithubConfiguration) HasStatus(comment, hash string) (bool, error) {
+	token, err := gc.apiToken()
+	if err != nil {
+		return false, err
+	}
+	if token == "" {
+		// we can't have posted one
+		return false, nil
+	}
+
+	if gc.IsApp() {
+		// as an app we post check runs rather than statuses
+		runs := struct {
+			TotalCount int `json:"total_count"`
+		}{}
+		url := fmt.Sprintf("%v/repos/%v/%v/commits/%v/check-runs?check_name=%v", githubApi, gc.User, gc.Repository, hash, neturl.QueryEscape(comment))
+		status, err := gc.apiGet(url, &runs)
+		if err != nil {
+			return false, err
+		}
+		if status != 200 {
+			return false, fmt.Errorf("Github refused to list check runs for %v (%v)", hash, status)
+		}
+		if runs.TotalCount > 0 {
+			return true, nil
+		}
+	}
+
+	// a busy commit may have more than a page of statuses
+	for page := 1; ; page++ {
+		statuses := []struct {
+			Context string
+		}{}
+		url := fmt.Sprintf("%v/repos/%v/%v/commits/%v/statuses?per_page=100&page=%v", githubApi, gc.User, gc.Repository, hash, page)
+		status, err := gc.apiGet(url, &statuses)
+		if err != nil {
+			return false, err
+		}
+		if status != 200 {
+			return false, fmt.Errorf("Github refused to list statuses for %v (%v)", hash, status)
+		}
+
+		for _, s := range statuses {
+			if s.Context == comment {
+				return true, nil
+			}
+		}
+		if len(statuses) < 100 {
+			return false, nil
+		}
 	}
-	return nil
 }
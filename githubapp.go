@@ -0,0 +1,146 @@
+/*
+githubapp.go - Github App authentication for Cix
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+)
+
+// True if this is configured to authenticate as a Github App
+func (gc *GithubConfiguration) IsApp() bool {
+	return gc.AppId != 0 && gc.InstallationId != 0 && (gc.PrivateKeyFile != "" || gc.PrivateKey != "")
+}
+
+// The app's private key as PEM, and where it came from for errors
+func (gc *GithubConfiguration) privateKeyPem() ([]byte, string, error) {
+	if gc.PrivateKey != "" {
+		return []byte(gc.PrivateKey.Value()), "privatekey", nil
+	}
+
+	blob, err := os.ReadFile(os.ExpandEnv(gc.PrivateKeyFile))
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read github app key %v: %v", gc.PrivateKeyFile, err)
+	}
+	return blob, gc.PrivateKeyFile, nil
+}
+
+func parseRsaKey(blob []byte, path string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(blob)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in github app key %v", path)
+	}
+
+	// Github issues PKCS1 keys, but accept PKCS8 in case it has been converted
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse github app key %v: %v", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Github app key %v is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// A short lived JWT identifying us as the app
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func (gc *GithubConfiguration) appJwt() (string, error) {
+	blob, path, err := gc.privateKeyPem()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := parseRsaKey(blob, path)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		// backdated to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": fmt.Sprintf("%v", gc.AppId),
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Failed to sign github app jwt: %v", err)
+	}
+
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// An installation access token, cached until shortly before it expires
+func (gc *GithubConfiguration) InstallationToken() (string, error) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	// these last an hour, refresh with plenty of time for a job to use it
+	if gc.token != "" && time.Now().Add(20*time.Minute).Before(gc.tokenExpiry) {
+		return gc.token, nil
+	}
+
+	jwt, err := gc.appJwt()
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%v/app/installations/%v/access_tokens", githubApi, gc.InstallationId)
+	headers := map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"X-GitHub-Api-Version": "2022-11-28",
+		"Authorization":        fmt.Sprintf("Bearer %v", jwt),
+	}
+
+	reply := struct {
+		Token     string
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := forgeCall("POST", url, headers, nil, &reply); err != nil {
+		return "", fmt.Errorf("Error requesting github installation token: %w", err)
+	}
+
+	gc.token = reply.Token
+	gc.tokenExpiry = reply.ExpiresAt
+	return gc.token, nil
+}
+
+// Drop the cached installation token if it is the one in authorization, so the next call gets a new one
+func (gc *GithubConfiguration) forgetToken(authorization string) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	if gc.token != "" && authorization == fmt.Sprintf("Bearer %v", gc.token) {
+		gc.token = ""
+	}
+}
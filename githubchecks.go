@@ -0,0 +1,238 @@
+/*
+githubchecks.go - Github Checks API support for Cix
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	neturl "net/url"
+	"time"
+)
+
+var _ DetailedRepoSource = &GithubConfiguration{}
+
+// Github limits each output field to 65535 characters
+const kCheckTextLimit = 60000
+
+// Lines of the log to show, nix's errors are at the end
+const kCheckTextLines = 200
+
+// Github limits annotations to 50 per request
+const kCheckAnnotationLimit = 50
+
+type checkAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title,omitempty"`
+	Message         string `json:"message"`
+}
+
+type checkOutput struct {
+	Title       string            `json:"title"`
+	Summary     string            `json:"summary"`
+	Text        string            `json:"text,omitempty"`
+	Annotations []checkAnnotation `json:"annotations,omitempty"`
+}
+
+type checkRun struct {
+	Name        string       `json:"name,omitempty"`
+	HeadSha     string       `json:"head_sha,omitempty"`
+	Status      string       `json:"status"`
+	Conclusion  string       `json:"conclusion,omitempty"`
+	StartedAt   *time.Time   `json:"started_at,omitempty"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	Output      *checkOutput `json:"output,omitempty"`
+}
+
+// Turn nix's errors into annotations on the commit
+func checkAnnotations(log string) []checkAnnotation {
+	annotations := []checkAnnotation{}
+	for _, ne := range ParseNixErrors(log) {
+		if ne.Path == "" || ne.Line == 0 {
+			// unlocated errors are in the summary, pinning them on a line would mislead
+			continue
+		}
+
+		a := checkAnnotation{
+			Path:            ne.Path,
+			StartLine:       ne.Line,
+			EndLine:         ne.Line,
+			AnnotationLevel: "failure",
+			Title:           "nix error",
+			Message:         ne.Message,
+		}
+		if a.Message == "" {
+			a.Message = "error"
+		}
+
+		annotations = append(annotations, a)
+		if len(annotations) == kCheckAnnotationLimit {
+			break
+		}
+	}
+	return annotations
+}
+
+func checkOutputFor(status CiStatus, description string, detail StatusDetail) *checkOutput {
+	out := &checkOutput{
+		Summary: fmt.Sprintf("Reproduce with\n\n```\n%v\n```", detail.Command),
+	}
+
+	switch status {
+	case KInProgress:
+		out.Title = "Running"
+
+	case KSucceeded:
+		out.Title = "Passed"
+
+	case KFailed:
+		out.Title = "Failed"
+		out.Annotations = checkAnnotations(detail.Log)
+
+	case KSkipped:
+		out.Title = "Skipped"
+
+	case KSuperseded:
+		out.Title = "Superseded"
+
+	default:
+		out.Title = "Error"
+	}
+
+	if description != "" && description != detail.Command {
+		out.Summary = description + "\n\n" + out.Summary
+	}
+	if detail.Log != "" {
+		out.Text = fmt.Sprintf("```\n%v\n```", LogTail(detail.Log, kCheckTextLines, kCheckTextLimit))
+	}
+	return out
+}
+
+// Send a check run to github, returning its id
+func (gc *GithubConfiguration) sendCheckRun(method, url string, run checkRun) (int64, error) {
+	created := struct {
+		Id int64
+	}{}
+	if err := gc.apiCall(method, url, run, &created); err != nil {
+		return 0, fmt.Errorf("Error posting github check run: %w", err)
+	}
+	return created.Id, nil
+}
+
+// The id of our check run for a commit that hasn't completed, 0 if there is none
+func (gc *GithubConfiguration) openCheckRun(comment, hash string) (int64, error) {
+	runs := struct {
+		CheckRuns []struct {
+			Id     int64
+			Status string
+		} `json:"check_runs"`
+	}{}
+	url := fmt.Sprintf("%v/repos/%v/%v/commits/%v/check-runs?check_name=%v&filter=latest", githubApi, gc.User, gc.Repository, hash, neturl.QueryEscape(comment))
+	status, err := gc.apiGet(url, &runs)
+	if err != nil {
+		return 0, err
+	}
+	if status != 200 {
+		return 0, fmt.Errorf("Github refused to list check runs for %v (%v)", hash, status)
+	}
+
+	for _, cr := range runs.CheckRuns {
+		if cr.Status != "completed" {
+			return cr.Id, nil
+		}
+	}
+	return 0, nil
+}
+
+// Uses the checks api when we are an app (it isn't available with a PAT), and statuses otherwise
+func (gc *GithubConfiguration) SetDetailedStatus(status CiStatus, comment, description, hash string, detail StatusDetail) error {
+	if !gc.IsApp() {
+		return gc.SetStatus(status, comment, description, hash)
+	}
+
+	now := time.Now()
+	run := checkRun{
+		Output: checkOutputFor(status, description, detail),
+	}
+
+	switch status {
+	case KInProgress:
+		run.Status = "in_progress"
+		run.StartedAt = &now
+
+	case KSucceeded:
+		run.Status = "completed"
+		run.Conclusion = "success"
+		run.CompletedAt = &now
+
+	case KSkipped:
+		run.Status = "completed"
+		run.Conclusion = "skipped"
+		run.CompletedAt = &now
+
+	case KSuperseded:
+		run.Status = "completed"
+		run.Conclusion = "cancelled"
+		run.CompletedAt = &now
+
+	default:
+		run.Status = "completed"
+		run.Conclusion = "failure"
+		run.CompletedAt = &now
+	}
+
+	key := comment + "/" + hash
+
+	gc.lock.Lock()
+	id, fnd := gc.checkRuns[key]
+	gc.lock.Unlock()
+
+	if !fnd {
+		// started before a restart (or a reload), so only github knows about it
+		var err error
+		id, err = gc.openCheckRun(comment, hash)
+		if err != nil {
+			return err
+		}
+		fnd = id != 0
+	}
+
+	if fnd {
+		url := fmt.Sprintf("%v/repos/%v/%v/check-runs/%v", githubApi, gc.User, gc.Repository, id)
+		_, err := gc.sendCheckRun("PATCH", url, run)
+		if err == nil && status != KInProgress {
+			gc.lock.Lock()
+			delete(gc.checkRuns, key)
+			gc.lock.Unlock()
+		}
+		return err
+	}
+
+	run.Name = comment
+	run.HeadSha = hash
+	url := fmt.Sprintf("%v/repos/%v/%v/check-runs", githubApi, gc.User, gc.Repository)
+	id, err := gc.sendCheckRun("POST", url, run)
+	if err != nil {
+		return err
+	}
+
+	if status == KInProgress {
+		gc.lock.Lock()
+		if gc.checkRuns == nil {
+			gc.checkRuns = map[string]int64{}
+		}
+		gc.checkRuns[key] = id
+		gc.lock.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+githubchecks_test.go - Tests of Github check runs
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A check run started before a restart is finished, rather than left in progress beside a new one
+func TestCheckRunFinishedAfterRestart(t *testing.T) {
+	hash := strings.Repeat("b", 40)
+
+	var lock sync.Mutex
+	calls := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+
+		if r.Method == "GET" {
+			if r.URL.Query().Get("check_name") != "cix" {
+				t.Errorf("listed check runs named %v", r.URL.Query().Get("check_name"))
+			}
+			fmt.Fprint(w, `{"total_count": 2, "check_runs": [{"id": 6, "status": "completed"}, {"id": 7, "status": "in_progress"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": 8}`)
+	}))
+	defer server.Close()
+
+	oldGithub := githubApi
+	githubApi = server.URL
+	t.Cleanup(func() { githubApi = oldGithub })
+
+	// a new configuration, as after a restart, that has no record of the run
+	gc := &GithubConfiguration{
+		User:           "owner",
+		Repository:     "repo",
+		AppId:          1,
+		InstallationId: 2,
+		PrivateKey:     "unused, the token is cached",
+		token:          "token",
+		tokenExpiry:    time.Now().Add(time.Hour),
+	}
+	if err := gc.SetDetailedStatus(KSucceeded, "cix", "", hash, StatusDetail{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GET /repos/owner/repo/commits/" + hash + "/check-runs",
+		"PATCH /repos/owner/repo/check-runs/7",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("called %v, expected %v", calls, expected)
+	}
+}
@@ -0,0 +1,445 @@
+/*
+harness_test.go - Fake forges, git remotes and nix for the tests
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A status a fake forge was sent
+type postedStatus struct {
+	// github, bitbucket or forgejo
+	Forge string
+
+	Hash        string
+	State       string
+	Context     string
+	Description string
+}
+
+// One server pretending to be the status apis of github, bitbucket and forgejo
+type fakeForge struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	statuses []postedStatus
+
+	// Fail this many posts with a 503
+	failures int
+
+	// The repositories github lists for discovery, and whether listing fails
+	repositories []string
+	listingDown  bool
+}
+
+var (
+	githubStatusRe    = regexp.MustCompile(`^/repos/[^/]+/[^/]+/statuses/([0-9a-f]{40})$`)
+	githubListRe      = regexp.MustCompile(`^/repos/[^/]+/[^/]+/commits/([0-9a-f]{40})/statuses$`)
+	bitbucketStatusRe = regexp.MustCompile(`^/repositories/[^/]+/[^/]+/commit/([0-9a-f]{40})/statuses/build/?[^/]*$`)
+	bitbucketListRe   = regexp.MustCompile(`^/repositories/[^/]+/[^/]+/commit/([0-9a-f]{40})/statuses$`)
+	forgejoStatusRe   = regexp.MustCompile(`^/api/v1/repos/[^/]+/[^/]+/statuses/([0-9a-f]{40})$`)
+	githubReposRe     = regexp.MustCompile(`^/(orgs|users)/[^/]+/repos$`)
+	forgejoListRe     = regexp.MustCompile(`^/api/v1/repos/[^/]+/[^/]+/commits/([0-9a-f]{40})/statuses$`)
+)
+
+func newFakeForge(t *testing.T) *fakeForge {
+	ff := &fakeForge{}
+	ff.server = httptest.NewServer(http.HandlerFunc(ff.serve))
+	t.Cleanup(ff.server.Close)
+
+	// point the forges at the fake
+	oldGithub, oldBitbucket, oldScheme := githubApi, bitbucketApi, forgeScheme
+	githubApi, bitbucketApi, forgeScheme = ff.server.URL, ff.server.URL, "http"
+	t.Cleanup(func() {
+		githubApi, bitbucketApi, forgeScheme = oldGithub, oldBitbucket, oldScheme
+	})
+
+	return ff
+}
+
+// Host (and port) of the fake, for forgejo's domain
+func (ff *fakeForge) Host() string {
+	u, _ := url.Parse(ff.server.URL)
+	return u.Host
+}
+
+func (ff *fakeForge) serve(w http.ResponseWriter, r *http.Request) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+
+	path := r.URL.Path
+	if r.Method == "GET" && githubReposRe.MatchString(path) {
+		if ff.listingDown {
+			http.Error(w, `{"message":"down for maintenance"}`, http.StatusServiceUnavailable)
+			return
+		}
+		// github's logins keep the case they were created with, whatever case the configuration uses
+		listed := []map[string]interface{}{}
+		for _, name := range ff.repositories {
+			listed = append(listed, map[string]interface{}{"name": name, "default_branch": "main", "owner": map[string]string{"login": "Owner"}})
+		}
+		json.NewEncoder(w).Encode(listed)
+		return
+	}
+
+	if r.Method == "GET" {
+		var contexts []string
+		var m []string
+		for _, re := range []*regexp.Regexp{githubListRe, bitbucketListRe, forgejoListRe} {
+			if m = re.FindStringSubmatch(path); m != nil {
+				break
+			}
+		}
+		if m == nil {
+			http.NotFound(w, r)
+			return
+		}
+		for _, ps := range ff.statuses {
+			if ps.Hash == m[1] {
+				contexts = append(contexts, ps.Context)
+			}
+		}
+
+		if bitbucketListRe.MatchString(path) {
+			values := []map[string]string{}
+			for _, c := range contexts {
+				values = append(values, map[string]string{"key": c})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": values})
+			return
+		}
+
+		// newest first and in pages, as github does
+		for i, j := 0, len(contexts)-1; i < j; i, j = i+1, j-1 {
+			contexts[i], contexts[j] = contexts[j], contexts[i]
+		}
+		perPage, page := 30, 1
+		fmt.Sscan(r.URL.Query().Get("per_page"), &perPage)
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+		listed := []map[string]string{}
+		for i, c := range contexts {
+			if i/perPage == page-1 {
+				listed = append(listed, map[string]string{"context": c})
+			}
+		}
+		json.NewEncoder(w).Encode(listed)
+		return
+	}
+
+	forge := ""
+	var m []string
+	if m = githubStatusRe.FindStringSubmatch(path); m != nil {
+		forge = "github"
+	} else if m = bitbucketStatusRe.FindStringSubmatch(path); m != nil {
+		forge = "bitbucket"
+	} else if m = forgejoStatusRe.FindStringSubmatch(path); m != nil {
+		forge = "forgejo"
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ff.failures > 0 {
+		ff.failures -= 1
+		http.Error(w, `{"message":"down for maintenance"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	body := struct {
+		State       string
+		Context     string
+		Key         string
+		Description string
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `{"message":"bad json"}`, http.StatusBadRequest)
+		return
+	}
+	if body.Context == "" {
+		body.Context = body.Key
+	}
+
+	ff.statuses = append(ff.statuses, postedStatus{
+		Forge:       forge,
+		Hash:        m[1],
+		State:       body.State,
+		Context:     body.Context,
+		Description: body.Description,
+	})
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("{}"))
+}
+
+// The statuses posted for a commit, oldest first
+func (ff *fakeForge) StatusesFor(hash string) []postedStatus {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+
+	ret := []postedStatus{}
+	for _, ps := range ff.statuses {
+		if ps.Hash == hash {
+			ret = append(ret, ps)
+		}
+	}
+	return ret
+}
+
+// The last state posted for a commit, "" if none
+func (ff *fakeForge) LastState(hash string) string {
+	statuses := ff.StatusesFor(hash)
+	if len(statuses) == 0 {
+		return ""
+	}
+	return statuses[len(statuses)-1].State
+}
+
+// Set the repositories github lists, and whether listing them fails
+func (ff *fakeForge) SetRepositories(names []string, down bool) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	ff.repositories = names
+	ff.listingDown = down
+}
+
+// Statuses from other runners, as on a busy commit
+func (ff *fakeForge) AddStatuses(hash string, contexts ...string) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	for _, c := range contexts {
+		ff.statuses = append(ff.statuses, postedStatus{Forge: "github", Hash: hash, State: "success", Context: c})
+	}
+}
+
+func (ff *fakeForge) FailNext(n int) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	ff.failures = n
+}
+
+// Everything a test needs: a folder, git remotes and a stub nix
+type harness struct {
+	t   *testing.T
+	dir string
+
+	forge *fakeForge
+
+	// Tested revisions are appended here by the stub nix
+	nixLog string
+
+	// The stub nix fails revisions listed here
+	nixBad string
+
+	// The json for the retry policies, none by default so failures are quick
+	Retry string
+}
+
+// Rewrites from the forges' ssh urls to folders of bare repositories
+func (h *harness) rewrites() map[string]string {
+	return map[string]string{
+		"git@github.com:":             filepath.Join(h.dir, "remotes", "github") + "/",
+		"git@bitbucket.org:":          filepath.Join(h.dir, "remotes", "bitbucket") + "/",
+		"git@" + h.forge.Host() + ":": filepath.Join(h.dir, "remotes", "forgejo") + "/",
+	}
+}
+
+func newHarness(t *testing.T) *harness {
+	h := &harness{
+		t:     t,
+		dir:   t.TempDir(),
+		forge: newFakeForge(t),
+		Retry: `{"status": {"attempts": -1}, "fetch": {"attempts": -1}, "nix": {"attempts": -1}}`,
+	}
+	h.nixLog = filepath.Join(h.dir, "nix.log")
+	h.nixBad = filepath.Join(h.dir, "nix.bad")
+
+	// git sees the forges' urls as local folders, and has someone to commit as
+	gitConfig := "[user]\n\tname = Cix Test\n\temail = test@example.com\n[init]\n\tdefaultBranch = main\n"
+	for from, to := range h.rewrites() {
+		gitConfig += fmt.Sprintf("[url %q]\n\tinsteadOf = %v\n", to, from)
+	}
+	h.write("gitconfig", gitConfig)
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(h.dir, "gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	// git, failing as many fetches as we ask it to
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.write("bin/git", fmt.Sprintf(`#!/bin/sh
+if [ "$1" = fetch ] && %[1]v; then
+	echo "fatal: unable to access the remote" >&2
+	exit 128
+fi
+exec %[2]v "$@"
+`, countdown(filepath.Join(h.dir, "fetch.failures")), realGit))
+	os.Chmod(filepath.Join(h.dir, "bin", "git"), 0755)
+	t.Setenv("PATH", filepath.Join(h.dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// nix, as far as cix can tell, that can die without saying why as many times as we ask it to
+	h.write("nix", fmt.Sprintf(`#!/bin/sh
+for a in "$@"; do case "$a" in *rev=*) rev=${a##*rev=};; esac; done
+echo "$rev" >> %[1]v
+if %[3]v; then
+	exit 1
+fi
+if [ -f %[2]v ] && grep -q "$rev" %[2]v; then
+	echo "error: builder for '/nix/store/00000000000000000000000000000000-check.drv' failed with exit code 1" >&2
+	exit 100
+fi
+`, h.nixLog, h.nixBad, countdown(filepath.Join(h.dir, "nix.failures"))))
+	os.Chmod(filepath.Join(h.dir, "nix"), 0755)
+
+	return h
+}
+
+func (h *harness) write(name, content string) string {
+	path := filepath.Join(h.dir, name)
+	os.MkdirAll(filepath.Dir(path), 0777)
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		h.t.Fatal(err)
+	}
+	return path
+}
+
+func (h *harness) git(dir string, args ...string) string {
+	h.t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		h.t.Fatalf("git %v: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// A remote for a repository's git url, with a working copy to commit from
+type testRemote struct {
+	h    *harness
+	work string
+}
+
+func (h *harness) newRemote(gitUrl string) *testRemote {
+	bare := ""
+	for from, to := range h.rewrites() {
+		if strings.HasPrefix(gitUrl, from) {
+			bare = to + strings.TrimPrefix(gitUrl, from)
+		}
+	}
+	if bare == "" {
+		h.t.Fatalf("no rewrite for %v", gitUrl)
+	}
+
+	os.MkdirAll(bare, 0777)
+	h.git(bare, "init", "--bare", "-b", "main")
+
+	tr := &testRemote{h: h, work: filepath.Join(h.dir, "work", filepath.Base(bare))}
+	h.git(h.dir, "clone", gitUrl, tr.work)
+	h.git(tr.work, "checkout", "-b", "main")
+	tr.Commit("initial")
+	return tr
+}
+
+// Make a commit, push it, and return its hash
+func (tr *testRemote) Commit(message string) string {
+	tr.h.t.Helper()
+
+	name := strings.ReplaceAll(message, " ", "-")
+	os.WriteFile(filepath.Join(tr.work, name), []byte(message), 0666)
+	tr.h.git(tr.work, "add", name)
+	tr.h.git(tr.work, "commit", "-q", "-m", message)
+	tr.h.git(tr.work, "push", "-q", "origin", "main")
+	return tr.h.git(tr.work, "rev-parse", "HEAD")
+}
+
+// Shell that is true, and counts down, while the number in a file is above zero
+func countdown(path string) string {
+	return fmt.Sprintf(`[ "$(cat %[1]v 2>/dev/null || echo 0)" -gt 0 ] && echo $(( $(cat %[1]v) - 1 )) > %[1]v`, path)
+}
+
+// Make the next n fetches fail
+func (h *harness) FailFetches(n int) {
+	h.write("fetch.failures", fmt.Sprintf("%v\n", n))
+}
+
+// Make the stub nix die, without an error message, the next n times it is run
+func (h *harness) BreakNix(n int) {
+	h.write("nix.failures", fmt.Sprintf("%v\n", n))
+}
+
+// Make the stub nix fail a commit
+func (h *harness) FailNix(hash string) {
+	f, err := os.OpenFile(h.nixBad, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintln(f, hash)
+}
+
+// The revisions nix was asked to check, in order
+func (h *harness) Tested() []string {
+	blob, _ := os.ReadFile(h.nixLog)
+	return strings.Fields(string(blob))
+}
+
+// Load a configuration for these repositories (as json objects), through the normal loader
+func (h *harness) Configuration(extra string, repositories ...string) Configuration {
+	h.t.Helper()
+
+	blob := fmt.Sprintf(`{
+	"var": %q,
+	"nixpath": %q,
+	"retry": %v,
+	%v
+	"repositories": [%v]
+}`, filepath.Join(h.dir, "var"), filepath.Join(h.dir, "nix"), h.Retry, extra, strings.Join(repositories, ","))
+
+	c, err := LoadConfiguration(h.write("config.json", blob))
+	if err != nil {
+		h.t.Fatalf("bad configuration: %v\n%v", err, blob)
+	}
+	return c
+}
+
+// Make everything in the outbox due, as if time had passed
+func makeOutboxDue(t *testing.T, c Configuration) {
+	entries, err := c.readOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		entry.NextAttempt = entry.NextAttempt.Add(-kMaxOutboxDelay)
+		if err := c.writeOutboxEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (h *harness) Tick(c Configuration) {
+	h.t.Helper()
+	if err := c.Tick(nil); err != nil {
+		h.t.Fatalf("tick failed: %v", err)
+	}
+}
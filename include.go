@@ -0,0 +1,302 @@
+/*
+include.go - Includes, defaults and templates in the Cix configuration
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+// Templates are applied to the json before it is decoded, as the decoded structs can't tell
+// a field that was left out from one set to its zero value.
+// Each file is strictly decoded on its own first, so errors point at the file they are in.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A configuration file as json, before templates are applied
+type configFile struct {
+	Path string
+	Blob []byte
+
+	// True if positions in Blob match the file on disk
+	Located bool
+
+	// The json as maps, keys of structs are lower cased
+	Raw map[string]interface{}
+}
+
+// Where a repository came from
+type repositoryOrigin struct {
+	File  *configFile
+	Index int
+}
+
+// Json keys match struct fields case insensitively, so lower case them to merge reliably
+// Maps (e.g. the templates) are keyed by name, so those are left alone
+func lowerKeys(v interface{}, isMap bool) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for k, child := range tv {
+			if !isMap {
+				k = strings.ToLower(k)
+			}
+			ret[k] = lowerKeys(child, false)
+		}
+		return ret
+
+	case []interface{}:
+		for i, child := range tv {
+			tv[i] = lowerKeys(child, false)
+		}
+	}
+	return v
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	blob, located, err := readConfigurationJson(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// strictly check the file on its own, so any error is located in it
+	if _, err := decodeConfiguration(path, blob); err != nil {
+		if !located {
+			err = unlocated(err)
+		}
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(blob))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, ConfigErrors{{File: path, Message: fmt.Sprintf("Configuration must be an object: %v", err)}}
+	}
+	if raw == nil {
+		raw = map[string]interface{}{}
+	}
+
+	for k, v := range raw {
+		delete(raw, k)
+		raw[strings.ToLower(k)] = lowerKeys(v, strings.ToLower(k) == "templates")
+	}
+
+	return &configFile{Path: path, Blob: blob, Located: located, Raw: raw}, nil
+}
+
+// An error at a json path in a file
+func (cf *configFile) errorAt(path, message string) ConfigError {
+	ce := ConfigError{File: cf.Path, Path: path, Message: message}
+	if cf.Located {
+		ce = indexJson(cf.Blob).locate(cf.Blob, ce)
+	}
+	return ce
+}
+
+// The files an include pattern refers to, relative to the including file
+func expandInclude(from, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from), pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Bad include pattern %v: %v", pattern, err)
+	}
+
+	// a glob matching nothing is fine (e.g. an empty team folder), a missing file isn't
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("Included file %v does not exist", pattern)
+	}
+	return matches, nil
+}
+
+// Merge repository settings, over takes precedence
+// Blocks (e.g. github) are merged field by field, anything deeper is replaced whole
+func mergeRepository(base, over map[string]interface{}) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for k, v := range base {
+		ret[k] = v
+	}
+
+	for k, v := range over {
+		bm, bok := ret[k].(map[string]interface{})
+		om, ook := v.(map[string]interface{})
+		if !bok || !ook {
+			ret[k] = v
+			continue
+		}
+
+		merged := map[string]interface{}{}
+		for bk, bv := range bm {
+			merged[bk] = bv
+		}
+		for ok, ov := range om {
+			merged[ok] = ov
+		}
+		ret[k] = merged
+	}
+	return ret
+}
+
+// Read a configuration and its includes, and apply the defaults and templates
+// The result is json for the whole configuration, where each repository came from, and every file read
+func assembleConfiguration(path string) ([]byte, []repositoryOrigin, []*configFile, error) {
+	root, err := readConfigFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	files := []*configFile{root}
+	ces := ConfigErrors{}
+
+	includes, _ := root.Raw["include"].([]interface{})
+	for i, pattern := range includes {
+		matches, err := expandInclude(path, fmt.Sprintf("%v", pattern))
+		if err != nil {
+			ces = append(ces, root.errorAt(fmt.Sprintf("include[%v]", i), err.Error()))
+			continue
+		}
+
+		for _, match := range matches {
+			cf, err := readConfigFile(match)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			keys := []string{}
+			for k := range cf.Raw {
+				if k != "repositories" && k != "templates" {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				ces = append(ces, cf.errorAt(k, "Only repositories and templates can be included"))
+			}
+
+			files = append(files, cf)
+		}
+	}
+
+	defaults, _ := root.Raw["defaults"].(map[string]interface{})
+	templates := map[string]map[string]interface{}{}
+	templateFiles := map[string]*configFile{}
+	for _, cf := range files {
+		fileTemplates, _ := cf.Raw["templates"].(map[string]interface{})
+		for name, t := range fileTemplates {
+			if other, fnd := templateFiles[name]; fnd {
+				ces = append(ces, cf.errorAt("templates."+strings.ToLower(name), fmt.Sprintf("Template %v is also defined in %v", name, other.Path)))
+				continue
+			}
+			templates[name], _ = t.(map[string]interface{})
+			templateFiles[name] = cf
+		}
+	}
+
+	// defaults, then the template, then the repository's own settings
+	resolve := func(cf *configFile, path string, r interface{}) map[string]interface{} {
+		repo, _ := r.(map[string]interface{})
+
+		merged := mergeRepository(map[string]interface{}{}, defaults)
+		if name, fnd := repo["template"]; fnd {
+			t, fnd := templates[fmt.Sprintf("%v", name)]
+			if !fnd {
+				ces = append(ces, cf.errorAt(path+".template", fmt.Sprintf("Unknown template \"%v\"", name)))
+				return nil
+			}
+			merged = mergeRepository(merged, t)
+		}
+		return mergeRepository(merged, repo)
+	}
+
+	repositories := []interface{}{}
+	origins := []repositoryOrigin{}
+	for _, cf := range files {
+		fileRepositories, _ := cf.Raw["repositories"].([]interface{})
+		for i, r := range fileRepositories {
+			merged := resolve(cf, fmt.Sprintf("repositories[%v]", i), r)
+			if merged == nil {
+				continue
+			}
+
+			repositories = append(repositories, merged)
+			origins = append(origins, repositoryOrigin{File: cf, Index: i})
+		}
+	}
+
+	// discovered repositories take their settings the same way
+	discover := []interface{}{}
+	rootDiscover, _ := root.Raw["discover"].([]interface{})
+	for i, d := range rootDiscover {
+		dm, _ := d.(map[string]interface{})
+		resolved := map[string]interface{}{}
+		for k, v := range dm {
+			resolved[k] = v
+		}
+		resolved["repository"] = resolve(root, fmt.Sprintf("discover[%v].repository", i), dm["repository"])
+		discover = append(discover, resolved)
+	}
+
+	if len(ces) > 0 {
+		return nil, nil, nil, ces
+	}
+
+	whole := map[string]interface{}{}
+	for k, v := range root.Raw {
+		whole[k] = v
+	}
+	whole["repositories"] = repositories
+	if len(discover) > 0 {
+		whole["discover"] = discover
+	}
+
+	blob, err := json.MarshalIndent(whole, "", "    ")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to assemble configuration: %v", err)
+	}
+	return blob, origins, files, nil
+}
+
+var repositoryPathRe = regexp.MustCompile(`^repositories\[([0-9]+)\]`)
+var repositoryRefRe = regexp.MustCompile(`repositories\[([0-9]+)\]`)
+
+// Move an error on the assembled configuration to the file the repository is in
+func locateAssembled(ce ConfigError, root *configFile, origins []repositoryOrigin) ConfigError {
+	// messages can refer to other repositories too
+	ce.Message = repositoryRefRe.ReplaceAllStringFunc(ce.Message, func(ref string) string {
+		i, _ := strconv.Atoi(repositoryRefRe.FindStringSubmatch(ref)[1])
+		if i >= len(origins) {
+			return ref
+		}
+		return fmt.Sprintf("%v repositories[%v]", origins[i].File.Path, origins[i].Index)
+	})
+
+	m := repositoryPathRe.FindStringSubmatch(ce.Path)
+	if m == nil {
+		return root.errorAt(ce.Path, ce.Message)
+	}
+
+	i, _ := strconv.Atoi(m[1])
+	if i >= len(origins) {
+		return root.errorAt(ce.Path, ce.Message)
+	}
+
+	origin := origins[i]
+	path := fmt.Sprintf("repositories[%v]", origin.Index) + strings.TrimPrefix(ce.Path, m[0])
+	return origin.File.errorAt(path, ce.Message)
+}
@@ -12,52 +12,405 @@ THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR I
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/steeleduncan/cix/version"
 )
 
-func usage() error {
-	fmt.Println(`cix ` + version.Version() + ` <config.json>`)
+type command struct {
+	Name string
+
+	// Arguments after the flags, for the usage
+	Arguments string
+
+	Help string
+
+	// Number of arguments after the flags (not counting an optional config path)
+	ArgumentCount int
+
+	// (optional) Add flags beyond those common to every command
+	Flags func(fs *flag.FlagSet, o *options)
+
+	Run func(options options, args []string) error
+}
+
+// Flags for the commands
+type options struct {
+	Verbose    bool
+	ConfigPath string
+
+	// Run here, even if a daemon is running
+	Local bool
+
+	// For backfill
+	Count int
+	Since string
+}
+
+func localFlag(fs *flag.FlagSet, o *options) {
+	fs.BoolVar(&o.Local, "local", false, "Run here rather than asking a running cix")
+}
+
+// Ask a running cix to do something, returning false if there isn't one
+func (o options) sendControl(c Configuration, path string, form url.Values) (bool, error) {
+	if o.Local {
+		return false, nil
+	}
+
+	reply, err := SendControl(c.ResolvedControlSocket(), path, form)
+	if err == errNoDaemon {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	fmt.Println(reply)
+	return true, nil
+}
+
+// Load the configuration the options point to
+func (o options) load() (Configuration, error) {
+	if o.ConfigPath == "" {
+		return Configuration{}, fmt.Errorf("No configuration, pass -config or set CIX_CONFIG")
+	}
+
+	c, err := LoadConfiguration(o.ConfigPath)
+	if err != nil {
+		return c, err
+	}
+
+	c.Verbose = c.Verbose || o.Verbose
+	return c, nil
+}
+
+var commands = []command{
+	{
+		Name:      "run",
+		Arguments: "[config.json]",
+		Help:      "Watch the repositories and test new commits until stopped",
+		Run: func(o options, args []string) error {
+			return runMain(o)
+		},
+	},
+	{
+		Name:      "once",
+		Arguments: "[config.json]",
+		Help:      "Test new commits once and exit, e.g. from cron or a systemd timer",
+		Run: func(o options, args []string) error {
+			c, err := o.load()
+			if err != nil {
+				return err
+			}
+			return c.Tick(c.HandleShutdown())
+		},
+	},
+	{
+		Name:      "validate",
+		Arguments: "[config.json]",
+		Help:      "Check a configuration",
+		Run: func(o options, args []string) error {
+			if _, err := o.load(); err != nil {
+				return err
+			}
+
+			fmt.Println(o.ConfigPath + ": ok")
+			return nil
+		},
+	},
+	{
+		Name:      "status",
+		Arguments: "[config.json]",
+		Help:      "Show the repositories and our copies of them",
+		Run:       statusMain,
+	},
+	{
+		Name:          "rebuild",
+		Arguments:     "<repository> <revision>",
+		Help:          "Test a commit (or branch) again, and post its status",
+		ArgumentCount: 2,
+		Flags:         localFlag,
+		Run:           rebuildMain,
+	},
+	{
+		Name:          "backfill",
+		Arguments:     "<repository>",
+		Help:          "Test the recent history of a branch, skipping commits we have a status for",
+		ArgumentCount: 1,
+		Flags: func(fs *flag.FlagSet, o *options) {
+			localFlag(fs, o)
+			fs.IntVar(&o.Count, "count", 0, "Test this many commits")
+			fs.StringVar(&o.Since, "since", "", "Test commits after this date (2006-01-02) or revision")
+		},
+		Run: backfillMain,
+	},
+	{
+		Name: "version",
+		Help: "Print the version",
+		Run: func(o options, args []string) error {
+			fmt.Println(`cix ` + version.Version())
+			return nil
+		},
+	},
+}
+
+// Returned after printing the usage for bad arguments
+var errUsage = errors.New("bad arguments")
+
+func usage() {
+	fmt.Println(`cix ` + version.Version())
+	fmt.Println()
+	fmt.Println(`Usage: cix <command> [-v] [-config config.json] [arguments]`)
+	fmt.Println(`       cix <config.json> (the same as cix run <config.json>)`)
+	fmt.Println()
+	for _, cmd := range commands {
+		fmt.Printf("  %-10v %-26v %v\n", cmd.Name, cmd.Arguments, cmd.Help)
+	}
+	fmt.Println()
+	fmt.Println(`The configuration defaults to $CIX_CONFIG`)
+}
+
+func statusMain(o options, args []string) error {
+	c, err := o.load()
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range c.AllRepositories() {
+		fmt.Println(repo.Name() + "@" + repo.Branch)
+
+		r := Repository{Path: filepath.Join(c.VarFolder(), repo.Identifier())}
+		if !r.Exists() {
+			fmt.Println("  not cloned yet")
+			continue
+		}
+		fmt.Println("  copy  ", r.Path)
+
+		tip, err := r.ResolveRevision(repo.Branch)
+		if err != nil {
+			fmt.Println("  tip    unknown: ", err)
+			continue
+		}
+		fmt.Println("  tip   ", tip)
+	}
+
+	if pending := c.OutboxSize(); pending > 0 {
+		fmt.Println()
+		fmt.Println(pending, " statuses waiting to be delivered")
+	}
 	return nil
 }
 
-func errMain() error {
-	if len(os.Args) != 2 {
-		return usage()
+func rebuildMain(o options, args []string) error {
+	c, err := o.load()
+	if err != nil {
+		return err
 	}
 
-	blob, err := os.ReadFile(os.Args[1])
+	if !ValidRevision(args[1]) {
+		return fmt.Errorf("Bad revision %v", args[1])
+	}
+
+	// if cix is running, let it do the work so two builds don't fight over the repository
+	sent, err := o.sendControl(c, "/rebuild", url.Values{"repository": {args[0]}, "revision": {args[1]}})
+	if sent || err != nil {
+		return err
+	}
+
+	return c.Rebuild(c.HandleShutdown(), args[0], args[1])
+}
+
+func backfillMain(o options, args []string) error {
+	c, err := o.load()
 	if err != nil {
-		return fmt.Errorf("Failed to read config at %v", os.Args[1])
+		return err
 	}
 
-	c := Configuration{}
-	err = json.Unmarshal(blob, &c)
+	if o.Count == 0 && o.Since == "" {
+		return fmt.Errorf("Backfill needs -count or -since")
+	}
+	if o.Since != "" && !ValidRevision(o.Since) {
+		return fmt.Errorf("Bad -since %v", o.Since)
+	}
+
+	form := url.Values{"repository": {args[0]}, "since": {o.Since}}
+	if o.Count > 0 {
+		form.Set("count", fmt.Sprintf("%v", o.Count))
+	}
+	sent, err := o.sendControl(c, "/backfill", form)
+	if sent || err != nil {
+		return err
+	}
+
+	return c.Backfill(c.HandleShutdown(), args[0], BackfillConfiguration{Count: o.Count, Since: o.Since})
+}
+
+func errMain() error {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		return errUsage
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].Name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+
+	if cmd == nil {
+		// the original interface, cix <config.json>
+		if len(args) == 1 && !strings.HasPrefix(args[0], "-") && args[0] != "help" {
+			return runMain(options{ConfigPath: args[0]})
+		}
+
+		usage()
+		if len(args) == 1 && (args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+			return nil
+		}
+		return errUsage
+	}
+
+	o := options{}
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	fs.BoolVar(&o.Verbose, "v", false, "Verbose output")
+	fs.StringVar(&o.ConfigPath, "config", os.Getenv("CIX_CONFIG"), "Path to the configuration")
+	if cmd.Flags != nil {
+		cmd.Flags(fs, &o)
+	}
+	if err := fs.Parse(args[1:]); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		// the flag package has already said what is wrong
+		return errUsage
+	}
+
+	rest := fs.Args()
+	if len(rest) == cmd.ArgumentCount+1 && strings.Contains(cmd.Arguments, "config.json") {
+		// the configuration can be given without -config
+		o.ConfigPath = rest[0]
+		rest = rest[1:]
+	}
+	if len(rest) != cmd.ArgumentCount {
+		usage()
+		return errUsage
+	}
+
+	return cmd.Run(o, rest)
+}
+
+// Run forever, reloading the configuration when it changes or on SIGHUP
+func runMain(o options) error {
+	c, err := o.load()
 	if err != nil {
-		return fmt.Errorf("Bad json: %v", err)
+		return err
 	}
-	c.Var = os.ExpandEnv(c.Var)
 
 	fmt.Println(`Cix ` + version.Version() + ` booting`)
 
+	reload := make(chan struct{}, 1)
+	watcher, err := WatchFiles(c.Files(), reload)
+	if err != nil {
+		// we can still reload on SIGHUP
+		fmt.Println("error: ", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	control, err := StartControlServer(c)
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	// the grace period is fixed at boot
+	sd := c.HandleShutdown()
+
+	// statuses the forge didn't accept are retried between ticks too
+	flush := time.NewTicker(time.Minute)
+	defer flush.Stop()
+
 	for {
-		err := c.Tick()
+		// a tick runs to completion under the configuration it started with
+		err := c.Tick(sd)
 		if err != nil {
 			fmt.Println("error: ", err)
 		}
+		if sd.Stopping() {
+			fmt.Println("Stopped")
+			return nil
+		}
+
+		next := time.Now().Add(3 * time.Minute)
+		fmt.Println("Sleeping, timeout at ", next)
+
+		reloading := false
+		for !reloading && time.Now().Before(next) {
+			select {
+			case <-time.After(time.Until(next)):
+
+			case job := <-control.Requests():
+				if err := job(c, sd); err != nil {
+					fmt.Println("error: ", err)
+				}
+
+			case <-flush.C:
+				if err := c.FlushOutbox(); err != nil {
+					fmt.Println("error: ", err)
+				}
 
-		fmt.Println("Sleeping, timeout at ", time.Now().Add(time.Minute * 3))
-		time.Sleep(3 * time.Minute)
+			case <-sd.Stopped():
+				fmt.Println("Stopped")
+				return nil
+
+			case <-reload:
+				reloading = true
+			case <-hup:
+				reloading = true
+			}
+		}
+		if !reloading {
+			continue
+		}
+
+		nc, err := o.load()
+		if err != nil {
+			fmt.Println("error: not reloading configuration: ", err)
+			continue
+		}
+
+		// and we tick straight away so new repositories are polled
+		fmt.Println("Reloaded configuration")
+		c = nc
+		control.SetConfiguration(c)
+
+		// the included files may have changed
+		if watcher != nil {
+			watcher.Close()
+		}
+		watcher, err = WatchFiles(c.Files(), reload)
+		if err != nil {
+			fmt.Println("error: ", err)
+		}
 	}
 }
 
 func main() {
 	err := errMain()
-	if err != nil {
+	if err == errUsage {
+		os.Exit(2)
+	} else if err != nil {
 		fmt.Println("fatal: ", err)
 		os.Exit(1)
 	} else {
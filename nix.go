@@ -12,42 +12,248 @@ THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR I
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"os/exec"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 func GetDescription(revision string, src RepoSource) string {
 	return "nix flake check -L " + src.NixUrl(revision)
 }
 
-func (c Configuration) RunChecks(repoPath, revision string) (bool, error) {
-	// NB we use our local copy for efficiency, but we need the nix url for returning to the user
-	cmd := exec.Command(
-		c.ResolvedNixPath(),
-		"flake", "check", "-L",
-		"--timeout", fmt.Sprintf("%v", c.ResolvedTimeout()),
-		"git+file://"+repoPath+"?rev="+revision,
-	)
-	cmd.Dir = "/tmp"
-	so, err := cmd.StderrPipe()
-	if err != nil {
-		return false, fmt.Errorf("Failed to create stdout pipe")
+// How a check ended
+type Outcome int
+
+const (
+	KPassed Outcome = iota
+
+	// A derivation failed to build, e.g. a test failed
+	KBuildFailed
+
+	// The flake failed to evaluate, e.g. a syntax error or missing attribute
+	KEvalError
+
+	// An input or dependency couldn't be downloaded
+	KFetchError
+
+	// The whole check took longer than the timeout, and was killed
+	KTimedOut
+
+	// Nix couldn't run properly, e.g. it is missing or the disk is full
+	KInfraError
+)
+
+// The commit status for an outcome, failures are the commit's fault, errors are not
+func (o Outcome) Status() CiStatus {
+	switch o {
+	case KPassed:
+		return KSucceeded
+
+	case KBuildFailed, KEvalError:
+		return KFailed
+
+	default:
+		return KError
+	}
+}
+
+func (o Outcome) String() string {
+	switch o {
+	case KPassed:
+		return "Passed"
+	case KBuildFailed:
+		return "Build failed"
+	case KEvalError:
+		return "Evaluation error"
+	case KFetchError:
+		return "Fetch failed"
+	case KTimedOut:
+		return "Timed out"
+	default:
+		return "Infrastructure error"
+	}
+}
+
+type CheckResult struct {
+	Outcome Outcome
+
+	// Nix's log output
+	Log string
+}
+
+// Error messages that mean something outside the flake went wrong
+var infraErrorRe = regexp.MustCompile(`(?i)no space left on device|cannot allocate memory|out of memory|cannot connect to socket|cannot connect to daemon|too many open files|database is locked`)
+
+// Error messages that mean an input or substitute couldn't be downloaded
+var fetchErrorRe = regexp.MustCompile(`(?i)unable to download|cannot download|failed to fetch|unable to fetch|while fetching|could not resolve host|couldn't resolve host|connection timed out|connection refused|failed to open archive`)
+
+// Error messages that mean a derivation was built, and failed
+var buildErrorRe = regexp.MustCompile(`(?i)builder for .* failed|build of .* failed|cannot build|dependencies of derivation .* failed to build|dependency failed`)
+
+// Work out how nix flake check ended from its exit code and log
+func ClassifyNixResult(exitCode int, log string) Outcome {
+	if exitCode == 0 {
+		return KPassed
+	}
+
+	// https://nix.dev/manual/nix/2.22/command-ref/nix-build
+	switch exitCode {
+	case 100, 102, 104:
+		// build failed, hash mismatch, not deterministic
+		return KBuildFailed
+	case 101:
+		// a single build hit nix's --timeout
+		return KTimedOut
+	}
+
+	// the other codes are generic, so go by nix's error messages, not the build logs
+	messages := []string{}
+	for _, line := range strings.Split(log, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "error:") {
+			messages = append(messages, line)
+		}
+	}
+	reported := strings.Join(messages, "\n")
+
+	switch {
+	case len(messages) == 0:
+		// nix died without saying why
+		return KInfraError
+	case infraErrorRe.MatchString(reported):
+		return KInfraError
+	case fetchErrorRe.MatchString(reported):
+		return KFetchError
+	case buildErrorRe.MatchString(reported):
+		return KBuildFailed
+	default:
+		return KEvalError
+	}
+}
+
+// Run the checks with a runner, stopping them if ctx is cancelled, when ctx.Err() is returned
+// or if they take longer than the timeout, when the outcome is KTimedOut
+func (c Configuration) RunChecks(parent context.Context, runner Runner, repo Repository, revision string) (CheckResult, error) {
+	if runner == nil {
+		return CheckResult{}, fmt.Errorf("No runner for %v", revision)
+	}
+
+	// nix's --timeout is per build, this covers evaluation and everything else too
+	ctx, cancel := context.WithTimeout(parent, c.TimeoutDuration())
+	defer cancel()
+
+	var log bytes.Buffer
+	var logs io.Writer = &log
+	if c.Verbose {
+		logs = io.MultiWriter(&log, os.Stdout)
 	}
 
-	if err := cmd.Start(); err != nil {
-		return false, fmt.Errorf("Failed to run nix check: %v", err)
+	check, err := runner.Start(CheckJob{Repo: repo, Revision: revision, Timeout: c.ResolvedTimeout()}, logs)
+	if err != nil {
+		return CheckResult{}, err
 	}
 
-	sout, _ := io.ReadAll(so)
-	err = cmd.Wait()
-	if cmd.ProcessState.ExitCode() == 100 {
-		// nix's code for build failure
-		// https://nix.dev/manual/nix/2.22/command-ref/nix-build
-		return false, nil
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			check.Cancel()
+		case <-finished:
+		}
+	}()
+
+	exitCode, err := check.Wait()
+	if parent.Err() != nil {
+		return CheckResult{Log: log.String()}, parent.Err()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return CheckResult{Outcome: KTimedOut, Log: log.String()}, nil
 	}
 	if err != nil {
-		fmt.Println(string(sout))
+		return CheckResult{Log: log.String()}, err
+	}
+
+	outcome := ClassifyNixResult(exitCode, log.String())
+	if outcome != KPassed && outcome != KBuildFailed && !c.Verbose {
+		fmt.Println(log.String())
+	}
+	return CheckResult{Outcome: outcome, Log: log.String()}, nil
+}
+
+// The last few lines of a log, for places with limited space
+func LogTail(log string, lines, maxBytes int) string {
+	all := strings.Split(strings.TrimRight(log, "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+
+	tail := strings.Join(all, "\n")
+	if len(tail) > maxBytes {
+		tail = tail[len(tail)-maxBytes:]
+
+		// don't start half way through a character
+		for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+			tail = tail[1:]
+		}
+	}
+	return tail
+}
+
+// An error nix reported, located in the source if possible
+type NixError struct {
+	// Path relative to the root of the flake, "" if unknown
+	Path string
+
+	// 1 based line number, 0 if unknown
+	Line int
+
+	Message string
+}
+
+// e.g. "at /nix/store/0123456789abcdfghijklmnpqrsvwxyz-source/checks/default.nix:12:5:"
+var nixLocationRe = regexp.MustCompile(`at /nix/store/[0-9a-z]{32}-source/([^:]+):([0-9]+):[0-9]+`)
+
+// Pick the errors out of a nix log
+func ParseNixErrors(log string) []NixError {
+	errs := []NixError{}
+
+	var current *NixError
+	for _, line := range strings.Split(log, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "error:") {
+			// a new top level error
+			if current != nil {
+				errs = append(errs, *current)
+			}
+			current = &NixError{Message: strings.TrimSpace(strings.TrimPrefix(line, "error:"))}
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		if m := nixLocationRe.FindStringSubmatch(trimmed); m != nil {
+			// nix prints the trace outermost first, so the last location is the most specific
+			current.Path = m[1]
+			current.Line, _ = strconv.Atoi(m[2])
+		} else if strings.HasPrefix(trimmed, "error:") {
+			// the final message at the bottom of a trace
+			current.Message = strings.TrimSpace(strings.TrimPrefix(trimmed, "error:"))
+		} else if current.Message == "" {
+			current.Message = trimmed
+		}
+	}
+
+	if current != nil {
+		errs = append(errs, *current)
 	}
-	return err == nil, nil
+	return errs
 }
@@ -0,0 +1,50 @@
+/*
+nix_test.go - Tests of nix log handling
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestLogTail(t *testing.T) {
+	if tail := LogTail("one\ntwo\nthree\n", 2, 100); tail != "two\nthree" {
+		t.Errorf("tail %q", tail)
+	}
+
+	// each é is two bytes, so an odd limit would cut one in half
+	log := strings.Repeat("é", 10)
+	for limit := 1; limit < len(log); limit++ {
+		tail := LogTail(log, 10, limit)
+		if !utf8.ValidString(tail) || len(tail) > limit {
+			t.Errorf("limit %v gave %q", limit, tail)
+		}
+	}
+}
+
+func TestCheckAnnotationsNeedALocation(t *testing.T) {
+	log := `error: flake 'git+file:///var/lib/cix/repo' does not provide attribute 'checks'
+error:
+       … while evaluating the attribute 'checks.x86_64-linux.test'
+         at /nix/store/0123456789abcdfghijklmnpqrsvwxyz-source/checks/default.nix:12:5:
+       error: undefined variable 'pkgz'
+`
+
+	annotations := checkAnnotations(log)
+	if len(annotations) != 1 {
+		t.Fatalf("annotations %+v", annotations)
+	}
+	if a := annotations[0]; a.Path != "checks/default.nix" || a.StartLine != 12 || a.Message != "undefined variable 'pkgz'" {
+		t.Errorf("annotation %+v", a)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+outbox.go - Statuses waiting to be delivered to the forge
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The longest we wait between attempts to deliver a status
+const kMaxOutboxDelay = time.Hour
+
+// A status update that hasn't reached the forge yet
+// There is one per commit and context, so a newer update replaces one that is still waiting
+type outboxEntry struct {
+	// Identifier of the repository
+	Repository string
+
+	Hash    string
+	Context string
+
+	Status      CiStatus
+	Description string
+	Detail      StatusDetail
+
+	// Failed deliveries so far, and when to try next
+	Attempts    int
+	NextAttempt time.Time
+}
+
+func (c Configuration) outboxFolder() string {
+	return filepath.Join(c.Var, "outbox")
+}
+
+func (c Configuration) outboxPath(repository, hash, context string) string {
+	key := sha256.Sum256([]byte(repository + "/" + hash + "/" + context))
+	return filepath.Join(c.outboxFolder(), fmt.Sprintf("%x.json", key[:16]))
+}
+
+// Write atomically, so a crash never leaves half an entry
+func (c Configuration) writeOutboxEntry(entry outboxEntry) error {
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(c.outboxFolder(), 0777)
+	path := c.outboxPath(entry.Repository, entry.Hash, entry.Context)
+	if err := os.WriteFile(path+".tmp", blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Post a status for an operation under our name
+// It is kept in the outbox until the forge accepts it, so it is retried (even after a restart) if the forge has trouble
+func (c Configuration) PostStatus(op Operation, status CiStatus, description string, detail StatusDetail) error {
+	if op.Source == nil {
+		return nil
+	}
+
+	detail = detail.Trimmed()
+	entry := outboxEntry{
+		Repository:  filepath.Base(op.Repo.Path),
+		Hash:        op.Hash,
+		Context:     c.ResolvedName(),
+		Status:      status,
+		Description: description,
+		Detail:      detail,
+	}
+	if err := c.writeOutboxEntry(entry); err != nil {
+		fmt.Println("error: failed to write to the outbox: ", err)
+	}
+
+	policy := c.Retry.ResolvedStatus()
+	_, err := policy.Do(forgeContext(), "Posting status", func() error {
+		return op.SetStatus(status, entry.Context, description, detail)
+	})
+	if err == nil || permanentError(err) {
+		os.Remove(c.outboxPath(entry.Repository, entry.Hash, entry.Context))
+	}
+	if err == nil {
+		return nil
+	}
+	if permanentError(err) {
+		fmt.Println("error: the forge refused the status for ", op.Hash, ": ", err)
+		return err
+	}
+
+	fmt.Println("error: failed to post status for ", op.Hash, ", will try again later: ", err)
+	entry.Attempts = policy.Attempts + 1
+	entry.NextAttempt = time.Now().Add(policy.outboxDelay(entry.Attempts))
+	c.writeOutboxEntry(entry)
+	return err
+}
+
+// Backoff for deliveries from the outbox, which carries on from the immediate retries but never gives up
+func (rp RetryPolicy) outboxDelay(attempts int) time.Duration {
+	delay := time.Duration(rp.Backoff) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 1; i < attempts && delay < kMaxOutboxDelay; i++ {
+		delay *= 2
+	}
+	if delay > kMaxOutboxDelay {
+		delay = kMaxOutboxDelay
+	}
+	return delay
+}
+
+func (c Configuration) readOutbox() ([]outboxEntry, error) {
+	entries, err := os.ReadDir(c.outboxFolder())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []outboxEntry{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(c.outboxFolder(), entry.Name())
+
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		oe := outboxEntry{}
+		if err := json.Unmarshal(blob, &oe); err != nil {
+			fmt.Println("error: removing broken outbox entry ", path)
+			os.Remove(path)
+			continue
+		}
+		ret = append(ret, oe)
+	}
+	return ret, nil
+}
+
+// The number of statuses waiting to be delivered
+func (c Configuration) OutboxSize() int {
+	entries, _ := c.readOutbox()
+	return len(entries)
+}
+
+// Try to deliver the statuses in the outbox that are due
+func (c Configuration) FlushOutbox() error {
+	entries, err := c.readOutbox()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	sources := map[string]RepoSource{}
+	for _, repo := range c.AllRepositories() {
+		sources[repo.Identifier()] = repo.Source()
+	}
+
+	policy := c.Retry.ResolvedStatus()
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.NextAttempt.After(now) {
+			continue
+		}
+		path := c.outboxPath(entry.Repository, entry.Hash, entry.Context)
+
+		source, fnd := sources[entry.Repository]
+		if !fnd && !c.DiscoveryCurrent() {
+			// it may be a discovered repository we don't know about yet, e.g. discovery is failing after a restart
+			if c.Verbose {
+				fmt.Println("Keeping status for ", entry.Hash, " until discovery succeeds")
+			}
+			continue
+		}
+		if !fnd {
+			fmt.Println("Dropping status for ", entry.Hash, ", its repository is no longer configured")
+			os.Remove(path)
+			continue
+		}
+
+		op := Operation{Source: source, Hash: entry.Hash}
+		err := op.SetStatus(entry.Status, entry.Context, entry.Description, entry.Detail)
+		if permanentError(err) {
+			fmt.Println("error: the forge refused the status for ", entry.Hash, ", dropping it: ", err)
+			os.Remove(path)
+			continue
+		}
+		if err != nil {
+			entry.Attempts += 1
+			entry.NextAttempt = now.Add(policy.outboxDelay(entry.Attempts))
+			fmt.Println("error: failed to post status for ", entry.Hash, " (attempt ", entry.Attempts, "), next try at ", entry.NextAttempt.Format(time.RFC3339), ": ", err)
+			c.writeOutboxEntry(entry)
+			continue
+		}
+
+		if c.Verbose {
+			fmt.Println("Delivered status for ", entry.Hash)
+		}
+		os.Remove(path)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+retry.go - Retrying things that fail for reasons outside our control
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The longest wait between retries, however many there are
+const kMaxRetryDelay = time.Hour
+
+// How to retry something that failed
+type RetryPolicy struct {
+	// (optional) Retries after the first attempt, 0 for the default, -1 for none
+	Attempts int
+
+	// (optional) Seconds to wait before the first retry, doubled for each one after
+	Backoff int
+}
+
+type RetryConfiguration struct {
+	// (optional) Fetching from the remote
+	Fetch *RetryPolicy
+
+	// (optional) Checks that hit an infrastructure or download error
+	Nix *RetryPolicy
+
+	// (optional) Posting statuses to the forge
+	Status *RetryPolicy
+}
+
+// A policy with the defaults filled in
+func (rp *RetryPolicy) resolve(attempts, backoff int) RetryPolicy {
+	resolved := RetryPolicy{Attempts: attempts, Backoff: backoff}
+	if rp == nil {
+		return resolved
+	}
+
+	if rp.Attempts != 0 {
+		resolved.Attempts = rp.Attempts
+	}
+	if resolved.Attempts < 0 {
+		resolved.Attempts = 0
+	}
+	if rp.Backoff != 0 {
+		resolved.Backoff = rp.Backoff
+	}
+	return resolved
+}
+
+func (rc RetryConfiguration) ResolvedFetch() RetryPolicy {
+	return rc.Fetch.resolve(3, 10)
+}
+
+func (rc RetryConfiguration) ResolvedNix() RetryPolicy {
+	return rc.Nix.resolve(2, 60)
+}
+
+func (rc RetryConfiguration) ResolvedStatus() RetryPolicy {
+	return rc.Status.resolve(3, 5)
+}
+
+// How long to wait before a retry (1 based)
+func (rp RetryPolicy) Delay(retry int) time.Duration {
+	if rp.Backoff >= int(kMaxRetryDelay/time.Second) {
+		return kMaxRetryDelay
+	}
+
+	delay := time.Duration(rp.Backoff) * time.Second
+	for i := 1; i < retry && delay < kMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > kMaxRetryDelay {
+		delay = kMaxRetryDelay
+	}
+	return delay
+}
+
+// Wait before a retry, false if ctx was cancelled first
+func (rp RetryPolicy) Wait(ctx context.Context, retry int) bool {
+	timer := time.NewTimer(rp.Delay(retry))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Call f until it succeeds, the retries run out or ctx is cancelled, returning the number of retries made
+// A forge refusing the call isn't retried, it would only refuse again
+func (rp RetryPolicy) Do(ctx context.Context, what string, f func() error) (int, error) {
+	err := f()
+	retries := 0
+	for err != nil && retries < rp.Attempts && !permanentError(err) {
+		retries += 1
+		fmt.Println("  ", what, " failed (", err, "), retry ", retries, " of ", rp.Attempts, " in ", rp.Delay(retries))
+		if !rp.Wait(ctx, retries) {
+			return retries, err
+		}
+		err = f()
+	}
+	return retries, err
+}
+
+// Suffix for a description, saying how many retries it took
+func retriesNote(retries int) string {
+	switch retries {
+	case 0:
+		return ""
+	case 1:
+		return " (after 1 retry)"
+	default:
+		return fmt.Sprintf(" (after %v retries)", retries)
+	}
+}
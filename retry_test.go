@@ -0,0 +1,40 @@
+/*
+retry_test.go - Tests of retry policies
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		policy RetryPolicy
+		retry  int
+		delay  time.Duration
+	}{
+		{RetryPolicy{Backoff: 10}, 1, 10 * time.Second},
+		{RetryPolicy{Backoff: 10}, 3, 40 * time.Second},
+		{RetryPolicy{Backoff: 0}, 5, 0},
+
+		// doubling would overflow, so it stops at the cap
+		{RetryPolicy{Backoff: 10}, 100, kMaxRetryDelay},
+		{RetryPolicy{Backoff: 10}, 1 << 30, kMaxRetryDelay},
+		{RetryPolicy{Backoff: 1 << 62}, 2, kMaxRetryDelay},
+	}
+
+	for _, tc := range cases {
+		if delay := tc.policy.Delay(tc.retry); delay != tc.delay {
+			t.Errorf("%+v retry %v waited %v, expected %v", tc.policy, tc.retry, delay, tc.delay)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+runner.go - Where and how checks are run
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+const (
+	// Run nix here, as us
+	KRunnerLocal = "local"
+
+	// Run nix here, in a transient systemd scope with resource limits
+	KRunnerSystemd = "systemd"
+)
+
+// A check of one revision of a repository
+type CheckJob struct {
+	Repo     Repository
+	Revision string
+
+	// Seconds nix may spend on a single build
+	Timeout int
+}
+
+// Something that can run a flake's checks, e.g. nix here, or on another machine
+type Runner interface {
+	// Start a check, nix's log is written to logs as it arrives
+	Start(job CheckJob, logs io.Writer) (RunningCheck, error)
+}
+
+// A check that has been started
+type RunningCheck interface {
+	// Stop the check, and anything it started
+	Cancel()
+
+	// Wait for the check to finish, and return nix's exit code
+	// An error means the runner failed, not that the check did
+	Wait() (int, error)
+}
+
+func (rc RepositoryConfiguration) ResolvedRunner() string {
+	if rc.Runner == "" {
+		return KRunnerLocal
+	}
+
+	return rc.Runner
+}
+
+// The runner a repository is configured to use
+func (c Configuration) RunnerFor(rc RepositoryConfiguration) (Runner, error) {
+	local := LocalRunner{NixPath: c.ResolvedNixPath()}
+	switch rc.ResolvedRunner() {
+	case KRunnerLocal:
+		return local, nil
+
+	case KRunnerSystemd:
+		limits := SystemdConfiguration{}
+		if rc.Systemd != nil {
+			limits = *rc.Systemd
+		}
+		limits.warnAboutDaemon()
+
+		// the builds may happen outside the scope, but nix limits them itself
+		local.Options = limits.nixOptions()
+		return SystemdRunner{LocalRunner: local, Limits: limits}, nil
+	}
+	return nil, fmt.Errorf("Unknown runner %v for %v", rc.Runner, rc.Name())
+}
+
+// Runs nix on this machine
+type LocalRunner struct {
+	NixPath string
+
+	// (optional) More options for nix flake check
+	Options []string
+}
+
+var _ Runner = LocalRunner{}
+
+// The nix command for a job
+// NB we use our local copy for efficiency, but we need the nix url for returning to the user
+func (lr LocalRunner) command(job CheckJob) *exec.Cmd {
+	args := []string{"flake", "check", "-L", "--timeout", fmt.Sprintf("%v", job.Timeout)}
+	args = append(args, lr.Options...)
+	cmd := exec.Command(lr.NixPath, append(args, "git+file://"+job.Repo.Path+"?rev="+job.Revision)...)
+	cmd.Dir = "/tmp"
+	if len(job.Repo.Env) > 0 {
+		// so any git+ssh inputs are fetched with the same credentials
+		cmd.Env = append(os.Environ(), job.Repo.Env...)
+	}
+	return cmd
+}
+
+func (lr LocalRunner) Start(job CheckJob, logs io.Writer) (RunningCheck, error) {
+	return startProcessCheck(lr.command(job), logs)
+}
+
+// A check run by a local process, which is killed with everything it started
+type processCheck struct {
+	cmd *exec.Cmd
+}
+
+func startProcessCheck(cmd *exec.Cmd, logs io.Writer) (RunningCheck, error) {
+	newProcessGroup(cmd)
+	cmd.Stderr = logs
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to run nix check: %v", err)
+	}
+	return processCheck{cmd: cmd}, nil
+}
+
+func (pc processCheck) Cancel() {
+	killProcessGroup(pc.cmd)
+}
+
+func (pc processCheck) Wait() (int, error) {
+	// a non zero exit is the check's result, not an error
+	pc.cmd.Wait()
+	if pc.cmd.ProcessState == nil {
+		return -1, fmt.Errorf("Lost track of nix check")
+	}
+	return pc.cmd.ProcessState.ExitCode(), nil
+}
@@ -0,0 +1,100 @@
+/*
+runner_test.go - Tests of the runners
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSystemdRunnerWrapsNix(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+
+	// records its arguments, and runs the command after --
+	invocations := filepath.Join(h.dir, "systemd-run.log")
+	stub := h.write("systemd-run", fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %v
+while [ "$1" != "--" ]; do shift; done
+shift
+exec "$@"
+`, invocations))
+	os.Chmod(stub, 0755)
+
+	old := systemdRunPath
+	systemdRunPath = stub
+	t.Cleanup(func() { systemdRunPath = old })
+
+	c := h.Configuration("", `{"github": {"user": "owner", "repository": "repo", "statuspat": "pat"}, "branch": "main",
+		"runner": "systemd", "systemd": {"cpuquota": "150%", "memorymax": "2G", "nice": 10, "ioweight": 20}}`)
+	h.Tick(c)
+
+	bad := remote.Commit("broken")
+	h.FailNix(bad)
+	h.Tick(c)
+
+	// nix's result comes back through systemd-run
+	if state := h.forge.LastState(bad); state != "failure" {
+		t.Fatalf("status %v, expected failure", state)
+	}
+
+	blob, err := os.ReadFile(invocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := string(blob)
+	for _, expected := range []string{"--user --scope", "--property=CPUQuota=150%", "--property=MemoryMax=2G", "--property=IOWeight=20", "--nice=10", "-- " + filepath.Join(h.dir, "nix") + " flake check",
+		// the quota reaches the builds, even if the daemon does them
+		"--max-jobs 1 --option cores 1"} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("systemd-run %v missing %v", args, expected)
+		}
+	}
+}
+
+func TestSystemdLimitsValidated(t *testing.T) {
+	c := Configuration{
+		Var: "/var/lib/cix",
+		Repositories: []RepositoryConfiguration{{
+			Github:  &GithubConfiguration{User: "owner", Repository: "repo"},
+			Branch:  "main",
+			Runner:  KRunnerSystemd,
+			Systemd: &SystemdConfiguration{CPUQuota: "2 cores", MemoryMax: "8G", Nice: 30},
+		}},
+	}
+
+	paths := []string{}
+	for _, ce := range c.Problems() {
+		paths = append(paths, ce.Path)
+	}
+	expected := "repositories[0].systemd.cpuquota repositories[0].systemd.nice"
+	if strings.Join(paths, " ") != expected {
+		t.Fatalf("problems at %v, expected %v", paths, expected)
+	}
+}
+
+func TestSystemdCpuQuotaReachesNix(t *testing.T) {
+	cases := map[string]string{
+		"":     "",
+		"50%":  "--max-jobs 1 --option cores 1",
+		"250%": "--max-jobs 1 --option cores 2",
+		"400%": "--max-jobs 1 --option cores 4",
+	}
+	for quota, expected := range cases {
+		if options := strings.Join(SystemdConfiguration{CPUQuota: quota}.nixOptions(), " "); options != expected {
+			t.Errorf("cpuquota %v gave %q, expected %q", quota, options, expected)
+		}
+	}
+}
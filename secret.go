@@ -0,0 +1,111 @@
+/*
+secret.go - Credentials in the configuration of Cix
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A credential from the configuration
+// In the json this is either the value inline, or a reference to where it can be found
+//
+//	"token": "inline value"
+//	"token": {"file": "/run/secrets/token"}
+//	"token": {"env": "TOKEN"}
+//	"token": {"credential": "token"}
+//
+// The last reads a credential passed with systemd's LoadCredential
+type Secret string
+
+// Where a secret can be found
+type SecretReference struct {
+	File       string
+	Env        string
+	Credential string
+}
+
+// The secret itself
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// Keep secrets out of logs
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "<secret>"
+}
+
+func (ref SecretReference) Resolve() (Secret, error) {
+	set := 0
+	for _, v := range []string{ref.File, ref.Env, ref.Credential} {
+		if v != "" {
+			set += 1
+		}
+	}
+	if set != 1 {
+		return "", fmt.Errorf("A secret needs exactly one of file, env or credential")
+	}
+
+	path := os.ExpandEnv(ref.File)
+	if ref.Env != "" {
+		v, fnd := os.LookupEnv(ref.Env)
+		if !fnd {
+			return "", fmt.Errorf("Secret environment variable %v is not set", ref.Env)
+		}
+		return Secret(v), nil
+	}
+
+	if ref.Credential != "" {
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", fmt.Errorf("Secret credential %v requested, but CREDENTIALS_DIRECTORY is not set (see LoadCredential in systemd.exec)", ref.Credential)
+		}
+		path = filepath.Join(dir, ref.Credential)
+	}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read secret: %v", err)
+	}
+
+	// files nearly always end in a newline that isn't part of the secret
+	return Secret(strings.TrimRight(string(blob), "\r\n")), nil
+}
+
+func (s *Secret) UnmarshalJSON(blob []byte) error {
+	var inline string
+	if err := json.Unmarshal(blob, &inline); err == nil {
+		*s = Secret(inline)
+		return nil
+	}
+
+	ref := SecretReference{}
+	dec := json.NewDecoder(bytes.NewReader(blob))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ref); err != nil {
+		return fmt.Errorf("A secret must be a string or an object with file, env or credential: %v", err)
+	}
+
+	v, err := ref.Resolve()
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
@@ -0,0 +1,318 @@
+/*
+shutdown.go - Stopping gracefully, and cleaning up after a stop that wasn't
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Test commits that were being tested when Cix stopped again
+	KOrphansRequeue = "requeue"
+
+	// Mark commits that were being tested when Cix stopped as errored
+	KOrphansError = "error"
+)
+
+func (c Configuration) ResolvedShutdownTimeout() int {
+	if c.ShutdownTimeout == 0 {
+		return 60
+	}
+
+	return c.ShutdownTimeout
+}
+
+func (c Configuration) ResolvedOrphans() string {
+	if c.Orphans == "" {
+		return KOrphansRequeue
+	}
+
+	return c.Orphans
+}
+
+// A graceful shutdown: first no new tests are started, then the running ones are killed
+// A nil *Shutdown never stops
+type Shutdown struct {
+	stopping chan struct{}
+	stopOnce sync.Once
+
+	// cancelled to kill the running tests
+	kill   context.Context
+	cancel context.CancelFunc
+}
+
+func NewShutdown() *Shutdown {
+	sd := &Shutdown{stopping: make(chan struct{})}
+	sd.kill, sd.cancel = context.WithCancel(context.Background())
+	return sd
+}
+
+// Stop starting tests, and kill the running ones after grace
+func (sd *Shutdown) Stop(grace time.Duration) {
+	sd.stopOnce.Do(func() {
+		close(sd.stopping)
+		time.AfterFunc(grace, sd.Kill)
+	})
+}
+
+// Kill the running tests now
+func (sd *Shutdown) Kill() {
+	sd.cancel()
+}
+
+// True once no new tests should be started
+func (sd *Shutdown) Stopping() bool {
+	if sd == nil {
+		return false
+	}
+
+	select {
+	case <-sd.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closed once no new tests should be started
+func (sd *Shutdown) Stopped() <-chan struct{} {
+	if sd == nil {
+		return nil
+	}
+	return sd.stopping
+}
+
+// Cancelled when running tests should be killed
+func (sd *Shutdown) Context() context.Context {
+	if sd == nil {
+		return context.Background()
+	}
+	return sd.kill
+}
+
+// Stop on SIGTERM or SIGINT, a second signal kills the running tests straight away
+func (sd *Shutdown) HandleSignals(grace time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		<-signals
+		fmt.Println("Stopping, waiting up to ", grace, " for running tests")
+		sd.Stop(grace)
+
+		<-signals
+		fmt.Println("Stopping now")
+		sd.Kill()
+	}()
+}
+
+// A Shutdown triggered by SIGTERM or SIGINT, with the configured grace period
+// Once it kills the tests, calls to the forges (and waits for their rate limits) stop too
+func (c Configuration) HandleShutdown() *Shutdown {
+	sd := NewShutdown()
+	sd.HandleSignals(time.Duration(c.ResolvedShutdownTimeout()) * time.Second)
+	setForgeContext(sd.Context())
+	return sd
+}
+
+// Written for each queued commit, and removed once it has a final status
+// Any left when Cix starts a tick weren't finished
+type runningMarker struct {
+	// Identifier of the repository
+	Repository string
+
+	Hash string
+
+	// True once the test started, so the forge shows it in progress
+	Started bool
+
+	// When it was first queued, to requeue in the same order
+	Queued time.Time
+
+	// The cix that queued it
+	Pid int
+
+	// And its processIdentity, as the pid may have been reused since (e.g. after a reboot)
+	Process string
+}
+
+func (c Configuration) runningFolder() string {
+	return filepath.Join(c.Var, "running")
+}
+
+func (c Configuration) markerPath(op Operation) string {
+	return filepath.Join(c.runningFolder(), filepath.Base(op.Repo.Path)+"-"+op.Hash+".json")
+}
+
+// Note a commit is queued (or started), so it isn't lost if we stop
+func (c Configuration) markRunning(op Operation, started bool) {
+	marker := runningMarker{
+		Repository: filepath.Base(op.Repo.Path),
+		Hash:       op.Hash,
+		Started:    started,
+		Queued:     time.Now(),
+		Pid:        os.Getpid(),
+		Process:    ourIdentity(),
+	}
+
+	// keep its place in the queue
+	if old, err := readMarker(c.markerPath(op)); err == nil {
+		marker.Queued = old.Queued
+	}
+
+	blob, _ := json.Marshal(marker)
+
+	os.MkdirAll(c.runningFolder(), 0777)
+	if err := os.WriteFile(c.markerPath(op), blob, 0666); err != nil {
+		fmt.Println("error: failed to mark ", op.Hash, " as running: ", err)
+	}
+}
+
+var ourIdentityOnce sync.Once
+var ourIdentityValue string
+
+// Our processIdentity, which doesn't change
+func ourIdentity() string {
+	ourIdentityOnce.Do(func() {
+		ourIdentityValue = processIdentity(os.Getpid())
+	})
+	return ourIdentityValue
+}
+
+// True if the cix that wrote a marker is still running
+func markerOwnerAlive(marker runningMarker) bool {
+	if !processAlive(marker.Pid) {
+		return false
+	}
+	if marker.Process == "" {
+		// written by an older cix, or where we can't tell processes apart
+		return true
+	}
+	return processIdentity(marker.Pid) == marker.Process
+}
+
+func readMarker(path string) (runningMarker, error) {
+	marker := runningMarker{}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return marker, err
+	}
+	if err := json.Unmarshal(blob, &marker); err != nil {
+		return marker, err
+	}
+	if !VerifyCommit(marker.Hash) {
+		return marker, fmt.Errorf("Did not understand hash: '%v'", marker.Hash)
+	}
+	return marker, nil
+}
+
+// The commit has a final status
+func (c Configuration) clearRunning(op Operation) {
+	os.Remove(c.markerPath(op))
+}
+
+// Commits a previous (or crashed) run didn't finish, those that were in progress are requeued or errored depending on orphans
+func (c Configuration) OrphanOperations() ([]Operation, error) {
+	entries, err := os.ReadDir(c.runningFolder())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	repos := map[string]RepositoryConfiguration{}
+	for _, repo := range c.AllRepositories() {
+		repos[repo.Identifier()] = repo
+	}
+
+	markers := []runningMarker{}
+	paths := map[string]string{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(c.runningFolder(), entry.Name())
+
+		marker, err := readMarker(path)
+		if err != nil {
+			fmt.Println("error: removing broken marker ", path, ": ", err)
+			os.Remove(path)
+			continue
+		}
+		markers = append(markers, marker)
+		paths[marker.Repository+marker.Hash] = path
+	}
+	sort.Slice(markers, func(i, j int) bool { return markers[i].Queued.Before(markers[j].Queued) })
+
+	ops := []Operation{}
+	for _, marker := range markers {
+		path := paths[marker.Repository+marker.Hash]
+
+		if marker.Pid != os.Getpid() && markerOwnerAlive(marker) {
+			// e.g. cix rebuild -local
+			continue
+		}
+
+		repo, fnd := repos[marker.Repository]
+		if !fnd && !c.DiscoveryCurrent() {
+			// it may be a discovered repository we don't know about yet
+			continue
+		}
+		if !fnd {
+			// no longer configured
+			os.Remove(path)
+			continue
+		}
+
+		r, _, err := c.OpenRepository(c.VarFolder(), repo)
+		if err != nil {
+			return nil, err
+		}
+		runner, err := c.RunnerFor(repo)
+		if err != nil {
+			return nil, err
+		}
+		op := Operation{
+			Repo:       r,
+			Hash:       marker.Hash,
+			Source:     repo.Source(),
+			Branch:     repo.Branch,
+			Autocancel: repo.Autocancel,
+			Runner:     runner,
+		}
+
+		if marker.Started && c.ResolvedOrphans() == KOrphansError {
+			fmt.Println("Interrupted ", marker.Hash)
+			c.PostStatus(op, KError, "Interrupted, Cix stopped while testing this", StatusDetail{})
+			os.Remove(path)
+			continue
+		}
+
+		if c.Verbose {
+			fmt.Println("  Requeue ", marker.Hash)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
@@ -0,0 +1,56 @@
+/*
+shutdown_test.go - Tests of recovering unfinished commits
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestOrphansOfReusedPidsAreRequeued(t *testing.T) {
+	h := newHarness(t)
+	remote := h.newRemote("git@github.com:owner/repo")
+	c := h.Configuration("", githubRepository("main"))
+	h.Tick(c)
+	hash := remote.Commit("interrupted")
+
+	// a process that is alive, standing in for another cix
+	other := exec.Command("sleep", "60")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Process.Kill()
+
+	repo := c.AllRepositories()[0]
+	op := Operation{Repo: Repository{Path: filepath.Join(c.VarFolder(), repo.Identifier())}, Hash: hash}
+	writeMarker := func(identity string) {
+		blob, _ := json.Marshal(runningMarker{Repository: repo.Identifier(), Hash: hash, Started: true, Pid: other.Process.Pid, Process: identity})
+		os.MkdirAll(c.runningFolder(), 0777)
+		os.WriteFile(c.markerPath(op), blob, 0666)
+	}
+
+	// still running it, so it is left alone
+	writeMarker(processIdentity(other.Process.Pid))
+	if ops, _ := c.OrphanOperations(); len(ops) != 0 {
+		t.Fatalf("took %v from a running cix", len(ops))
+	}
+
+	// the pid now belongs to something else, e.g. after a reboot
+	writeMarker("a cix from before a reboot")
+	ops, _ := c.OrphanOperations()
+	if len(ops) != 1 || ops[0].Hash != hash {
+		t.Fatalf("orphans %+v", ops)
+	}
+}
@@ -13,14 +13,26 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
 )
 
 type SshConfiguration struct {
 	// The git repository URL
 	Remote string
+
+	// (optional) Private key to use for this repository only, e.g. a deploy key
+	IdentityFile string
+
+	// (optional) known_hosts file to use instead of the user's
+	KnownHosts string
+
+	// (optional) Value for ssh's StrictHostKeyChecking (yes, no, accept-new)
+	StrictHostKeyChecking string
 }
 
-var _ RepoSource = &GithubConfiguration{}
+var _ RepoSource = &SshConfiguration{}
+var _ GitEnvSource = &SshConfiguration{}
 
 func (sc *SshConfiguration) Valid() bool {
 	if sc == nil {
@@ -42,3 +54,36 @@ func (sc *SshConfiguration) NixUrl(revision string) string {
 func (sc *SshConfiguration) GitUrl() string {
 	return sc.Remote
 }
+
+// Quote a string for the shell that git runs GIT_SSH_COMMAND with
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// The ssh command line for this repository, or "" for git's default
+func (sc *SshConfiguration) SshCommand() string {
+	args := []string{}
+	if sc.IdentityFile != "" {
+		args = append(args, "-i", shellQuote(os.ExpandEnv(sc.IdentityFile)), "-o", "IdentitiesOnly=yes")
+	}
+	if sc.KnownHosts != "" {
+		args = append(args, "-o", shellQuote("UserKnownHostsFile="+os.ExpandEnv(sc.KnownHosts)))
+	}
+	if sc.StrictHostKeyChecking != "" {
+		args = append(args, "-o", shellQuote("StrictHostKeyChecking="+sc.StrictHostKeyChecking))
+	}
+
+	if len(args) == 0 {
+		return ""
+	}
+	return "ssh " + strings.Join(args, " ")
+}
+
+func (sc *SshConfiguration) GitEnv() ([]string, error) {
+	cmd := sc.SshCommand()
+	if cmd == "" {
+		return nil, nil
+	}
+
+	return []string{"GIT_SSH_COMMAND=" + cmd}, nil
+}
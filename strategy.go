@@ -0,0 +1,160 @@
+/*
+strategy.go - Choosing which new commits to test
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// Test every new commit
+	KStrategyAll = "all"
+
+	// Only test the new tip of the branch
+	KStrategyTip = "tip"
+
+	// Test the new commits on the first parent chain from the tip, e.g. the merges into main
+	KStrategyFirstParent = "tip+first-parent"
+
+	// Another name for KStrategyFirstParent
+	KStrategyFirstParentAlias = "first-parent"
+
+	// Test every Nth commit on the first parent chain, counting from the tip
+	KStrategyEvery = "every"
+)
+
+func (rc RepositoryConfiguration) ResolvedStrategy() string {
+	switch rc.Strategy {
+	case "":
+		return KStrategyAll
+	case KStrategyFirstParentAlias:
+		return KStrategyFirstParent
+	}
+
+	return rc.Strategy
+}
+
+// Operations for the new commits on a branch (newest first), those the strategy doesn't pick are skipped
+// tipBefore is the tip of the branch before the fetch, failures are bisected from it only if it passed
+func (c Configuration) StrategyOperations(repo RepositoryConfiguration, r Repository, newCommits []string, tipBefore string) ([]Operation, error) {
+	strategy := repo.ResolvedStrategy()
+
+	chosen := map[string]bool{}
+	switch strategy {
+	case KStrategyAll:
+		for _, hash := range newCommits {
+			chosen[hash] = true
+		}
+
+	case KStrategyTip:
+		tip, err := r.ResolveRevision(repo.Branch)
+		if err != nil {
+			return nil, err
+		}
+		chosen[tip] = true
+
+	default:
+		hashes, err := r.FirstParentCommits(repo.Branch, tipBefore)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, hash := range hashes {
+			if strategy == KStrategyEvery && repo.Every > 0 && i%repo.Every != 0 {
+				continue
+			}
+			chosen[hash] = true
+		}
+	}
+
+	// bisecting from a commit that failed (or was never tested) would blame the wrong one
+	var bisectFrom []string
+	if repo.Bisect && strategy != KStrategyAll && tipBefore != "" {
+		if r.PassedTip(repo.Branch) == tipBefore {
+			bisectFrom = []string{tipBefore}
+		} else if c.Verbose {
+			fmt.Println("  Not bisecting, ", tipBefore, " isn't known to pass")
+		}
+	}
+
+	runner, err := c.RunnerFor(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []Operation{}
+	for _, hash := range c.OrderCommits(newCommits) {
+		skip := !chosen[hash]
+		if c.Verbose {
+			if skip {
+				fmt.Println("  New commit (skipped) ", hash)
+			} else {
+				fmt.Println("  New commit ", hash)
+			}
+		}
+
+		ops = append(ops, Operation{
+			Repo:       r,
+			Hash:       hash,
+			Source:     repo.Source(),
+			Skip:       skip,
+			BisectFrom: bisectFrom,
+			Branch:     repo.Branch,
+			Autocancel: repo.Autocancel,
+			Runner:     runner,
+		})
+	}
+	return ops, nil
+}
+
+// Mark a commit as deliberately not tested, so the forge doesn't show it as pending forever
+// It is recorded locally too, as not every forge shows a skipped status (see StatusReader)
+func (c Configuration) SkipCommit(op Operation) error {
+	noted := op.Repo.NoteSkipped(op.Hash)
+	if err := c.PostStatus(op, KSkipped, "Skipped, a later commit was tested", StatusDetail{}); err != nil {
+		return err
+	}
+	return noted
+}
+
+// After a test fails, test the skipped commits between it and the good ones to find the first failure
+func (c Configuration) BisectFailure(ctx context.Context, op Operation, good []string) (string, error) {
+	bad := op.Hash
+	for {
+		mid, err := op.Repo.BisectMidpoint(bad, good)
+		if err != nil {
+			return "", err
+		}
+		if mid == "" {
+			fmt.Println("First failing commit ", bad)
+			return bad, nil
+		}
+
+		status, err := c.Execute(ctx, Operation{
+			Repo:   op.Repo,
+			Hash:   mid,
+			Source: op.Source,
+			Branch: op.Branch,
+			Runner: op.Runner,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		if status == KSucceeded {
+			good = append(good, mid)
+		} else {
+			bad = mid
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+systemd.go - Running checks in systemd scopes with resource limits
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Limits on the resources a check may use, so it doesn't take over the machine
+// See systemd.resource-control(5) for the details of each
+type SystemdConfiguration struct {
+	// (optional) CPU time the check may use, e.g. "200%" for two cores
+	CPUQuota string
+
+	// (optional) Memory the check may use, e.g. "8G"
+	MemoryMax string
+
+	// (optional) Nice level for the check, 1 (a little nicer) to 19 (the nicest), 0 leaves it as ours
+	Nice int
+
+	// (optional) Share of the disk bandwidth when it is contended, 1 to 10000, systemd's default is 100
+	IOWeight int
+}
+
+var cpuQuotaRe = regexp.MustCompile(`^[0-9]+%$`)
+var memoryMaxRe = regexp.MustCompile(`^([0-9]+[KMGT]?|[0-9]+%|infinity)$`)
+
+// Everything wrong with the limits, located by json path
+func (sc *SystemdConfiguration) Problems(path string) ConfigErrors {
+	ces := ConfigErrors{}
+	if sc == nil {
+		return ces
+	}
+
+	if sc.CPUQuota != "" && !cpuQuotaRe.MatchString(sc.CPUQuota) {
+		ces = append(ces, ConfigError{Path: path + ".cpuquota", Message: fmt.Sprintf("Invalid cpuquota \"%v\" (a percentage, e.g. 200%%)", sc.CPUQuota)})
+	}
+	if sc.MemoryMax != "" && !memoryMaxRe.MatchString(sc.MemoryMax) {
+		ces = append(ces, ConfigError{Path: path + ".memorymax", Message: fmt.Sprintf("Invalid memorymax \"%v\" (bytes with an optional K, M, G or T, e.g. 8G)", sc.MemoryMax)})
+	}
+	if sc.Nice < 0 || sc.Nice > 19 {
+		ces = append(ces, ConfigError{Path: path + ".nice", Message: "Nice must be 1 to 19 (or 0 to leave it as ours)"})
+	}
+	if sc.IOWeight < 0 || sc.IOWeight > 10000 {
+		ces = append(ces, ConfigError{Path: path + ".ioweight", Message: "IOWeight must be 1 to 10000 (or 0 to leave it as systemd's default)"})
+	}
+	return ces
+}
+
+// Options for nix so the builds keep to the cpu quota, even when the daemon does them outside our scope
+func (sc SystemdConfiguration) nixOptions() []string {
+	if !cpuQuotaRe.MatchString(sc.CPUQuota) {
+		return nil
+	}
+
+	// one build at a time, with as many cores as the quota allows
+	percent, _ := strconv.Atoi(strings.TrimSuffix(sc.CPUQuota, "%"))
+	cores := percent / 100
+	if cores < 1 {
+		cores = 1
+	}
+	return []string{"--max-jobs", "1", "--option", "cores", fmt.Sprintf("%v", cores)}
+}
+
+// True if nix builds in a daemon rather than as us, e.g. the default multi user install on NixOS
+func nixUsesDaemon() bool {
+	switch remote := os.Getenv("NIX_REMOTE"); remote {
+	case "", "auto":
+		// nix uses the daemon if it can't write to the store itself
+		_, err := os.Stat("/nix/var/nix/daemon-socket/socket")
+		return err == nil && os.Getuid() != 0
+
+	case "local":
+		return false
+
+	default:
+		return true
+	}
+}
+
+var daemonWarning sync.Once
+
+// The scope's limits don't reach builds done by the nix daemon, so say which won't apply to them
+func (sc SystemdConfiguration) warnAboutDaemon() {
+	if (sc.MemoryMax == "" && sc.Nice == 0 && sc.IOWeight == 0) || !nixUsesDaemon() {
+		return
+	}
+
+	daemonWarning.Do(func() {
+		fmt.Println("warning: nix builds in its daemon, outside the systemd scope, so memorymax, nice and ioweight only limit evaluation")
+		fmt.Println("warning: limit nix-daemon.service itself to cover the builds, cpuquota is passed to nix as cores and max-jobs")
+	})
+}
+
+// Runs nix here, in a transient scope of the user's systemd so its resources can be limited
+// NB with a multi user nix install the builds are done by the nix daemon, outside the scope, so only nixOptions reach them
+type SystemdRunner struct {
+	LocalRunner
+
+	Limits SystemdConfiguration
+}
+
+var _ Runner = SystemdRunner{}
+
+// systemd-run, a variable so the tests can replace it
+var systemdRunPath = "systemd-run"
+
+// The nix command, wrapped in systemd-run
+func (sr SystemdRunner) command(job CheckJob) *exec.Cmd {
+	nix := sr.LocalRunner.command(job)
+
+	// in a scope systemd-run execs nix itself, so it stays in our process group and can be killed
+	args := []string{"--user", "--scope", "--quiet", "--collect", "--description=cix check of " + job.Revision}
+	properties := map[string]string{
+		"CPUQuota":  sr.Limits.CPUQuota,
+		"MemoryMax": sr.Limits.MemoryMax,
+	}
+	if sr.Limits.IOWeight > 0 {
+		properties["IOWeight"] = fmt.Sprintf("%v", sr.Limits.IOWeight)
+	}
+	for _, name := range []string{"CPUQuota", "MemoryMax", "IOWeight"} {
+		if properties[name] != "" {
+			args = append(args, "--property="+name+"="+properties[name])
+		}
+	}
+	if sr.Limits.Nice > 0 {
+		args = append(args, fmt.Sprintf("--nice=%v", sr.Limits.Nice))
+	}
+	args = append(args, "--")
+	args = append(args, nix.Args...)
+
+	cmd := exec.Command(systemdRunPath, args...)
+	cmd.Dir = nix.Dir
+	cmd.Env = nix.Env
+	return cmd
+}
+
+func (sr SystemdRunner) Start(job CheckJob, logs io.Writer) (RunningCheck, error) {
+	return startProcessCheck(sr.command(job), logs)
+}
@@ -0,0 +1,398 @@
+/*
+validate.go - Validation of the Cix configuration
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A problem with the configuration
+type ConfigError struct {
+	// The file it is in, if known
+	File string
+
+	// Json path to the problem, e.g. repositories[2].github
+	Path string
+
+	// 1 based position in the file, 0 if unknown
+	Line, Column int
+
+	Message string
+}
+
+func (ce ConfigError) Error() string {
+	where := []string{}
+	if ce.File != "" {
+		where = append(where, ce.File)
+	}
+
+	if ce.Line > 0 {
+		where = append(where, fmt.Sprintf("%v:%v", ce.Line, ce.Column))
+	} else if ce.Path != "" {
+		where = append(where, ce.Path)
+	}
+
+	if len(where) == 0 {
+		return ce.Message
+	}
+	return strings.Join(where, ":") + ": " + ce.Message
+}
+
+// All the problems found
+type ConfigErrors []ConfigError
+
+func (ces ConfigErrors) Error() string {
+	lines := []string{}
+	for _, ce := range ces {
+		lines = append(lines, ce.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Convert a byte offset to a 1 based line and column
+func lineColumn(blob []byte, offset int64) (int, int) {
+	if offset > int64(len(blob)) {
+		offset = int64(len(blob))
+	}
+
+	before := blob[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// Where in a json document each path starts, keys are lower case as json matching is case insensitive
+type jsonPositions map[string]int64
+
+func skipJsonSpace(blob []byte, offset int64) int64 {
+	for offset < int64(len(blob)) {
+		switch blob[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset += 1
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func (jp jsonPositions) walk(blob []byte, dec *json.Decoder, path string) error {
+	start := skipJsonSpace(blob, dec.InputOffset())
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if _, fnd := jp[path]; !fnd {
+		jp[path] = start
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			keyStart := skipJsonSpace(blob, dec.InputOffset())
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			child := strings.ToLower(fmt.Sprintf("%v", key))
+			if path != "" {
+				child = path + "." + child
+			}
+			// point at the key rather than the value
+			jp[child] = keyStart
+			if err := jp.walk(blob, dec, child); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := jp.walk(blob, dec, fmt.Sprintf("%v[%v]", path, i)); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+// Index a json document, a broken document gives an empty index
+func indexJson(blob []byte) jsonPositions {
+	jp := jsonPositions{}
+	dec := json.NewDecoder(bytes.NewReader(blob))
+	if err := jp.walk(blob, dec, ""); err != nil {
+		return jsonPositions{}
+	}
+	return jp
+}
+
+// Locate an error at a json path
+func (jp jsonPositions) locate(blob []byte, ce ConfigError) ConfigError {
+	if offset, fnd := jp[strings.ToLower(ce.Path)]; fnd {
+		ce.Line, ce.Column = lineColumn(blob, offset)
+	}
+	return ce
+}
+
+var unknownFieldRe = regexp.MustCompile(`unknown field "([^"]*)"`)
+
+// Turn an error from decoding into a located ConfigError
+func (jp jsonPositions) decodeError(file string, blob []byte, err error) ConfigError {
+	ce := ConfigError{File: file, Message: err.Error()}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		ce.Message = fmt.Sprintf("Bad json: %v", syntaxErr)
+		ce.Line, ce.Column = lineColumn(blob, syntaxErr.Offset)
+
+	case errors.As(err, &typeErr):
+		ce.Message = fmt.Sprintf("Expected %v for %v, got %v", typeErr.Type, typeErr.Field, typeErr.Value)
+		ce.Path = typeErr.Field
+		ce.Line, ce.Column = lineColumn(blob, typeErr.Offset)
+
+	case unknownFieldRe.MatchString(err.Error()):
+		// the decoder doesn't say where, so find the first key of that name
+		name := unknownFieldRe.FindStringSubmatch(err.Error())[1]
+		ce.Message = fmt.Sprintf("Unknown field \"%v\"", name)
+
+		paths := []string{}
+		for path := range jp {
+			if path == strings.ToLower(name) || strings.HasSuffix(path, "."+strings.ToLower(name)) {
+				paths = append(paths, path)
+			}
+		}
+		sort.Slice(paths, func(i, j int) bool { return jp[paths[i]] < jp[paths[j]] })
+		if len(paths) > 0 {
+			ce.Path = paths[0]
+			ce.Line, ce.Column = lineColumn(blob, jp[paths[0]])
+		}
+	}
+	return ce
+}
+
+// Strictly decode a json configuration, rejecting unknown fields
+func decodeConfiguration(file string, blob []byte) (Configuration, error) {
+	c := Configuration{}
+
+	dec := json.NewDecoder(bytes.NewReader(blob))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, ConfigErrors{indexJson(blob).decodeError(file, blob, err)}
+	}
+
+	// there should be nothing after the configuration
+	if _, err := dec.Token(); err != io.EOF {
+		line, column := lineColumn(blob, dec.InputOffset())
+		return c, ConfigErrors{{File: file, Line: line, Column: column, Message: "Unexpected data after the configuration"}}
+	}
+
+	return c, nil
+}
+
+// Positions in json converted from another format are meaningless, so fall back to the json path
+func unlocated(err error) error {
+	ces, ok := err.(ConfigErrors)
+	if !ok {
+		return err
+	}
+
+	for i := range ces {
+		ces[i].Line = 0
+		ces[i].Column = 0
+	}
+	return ces
+}
+
+// Read, decode and validate a configuration file, with its includes
+func LoadConfiguration(file string) (Configuration, error) {
+	blob, origins, files, err := assembleConfiguration(file)
+	if err != nil {
+		return Configuration{}, err
+	}
+
+	c, err := decodeConfiguration(file, blob)
+	if err != nil {
+		return c, unlocated(err)
+	}
+	c.Var = os.ExpandEnv(c.Var)
+
+	for _, cf := range files {
+		c.files = append(c.files, cf.Path)
+	}
+	c.discovered = &discoveryCache{}
+
+	ces := c.Problems()
+	if len(ces) > 0 {
+		for i, ce := range ces {
+			ces[i] = locateAssembled(ce, files[0], origins)
+		}
+		return c, ces
+	}
+
+	// so commands see the discovered repositories without asking the forge
+	if err := c.LoadDiscovery(); err != nil {
+		fmt.Println("error: ", err)
+	}
+	return c, nil
+}
+
+// Everything wrong with the configuration, located by json path
+func (c Configuration) Problems() ConfigErrors {
+	ces := ConfigErrors{}
+
+	if c.Var == "" {
+		ces = append(ces, ConfigError{Message: "Missing var folder"})
+	}
+
+	if c.Orphans != "" && c.Orphans != KOrphansRequeue && c.Orphans != KOrphansError {
+		ces = append(ces, ConfigError{Path: "orphans", Message: fmt.Sprintf("Unknown orphans \"%v\" (requeue or error)", c.Orphans)})
+	}
+
+	policies := []struct {
+		path   string
+		policy *RetryPolicy
+	}{{"retry.fetch", c.Retry.Fetch}, {"retry.nix", c.Retry.Nix}, {"retry.status", c.Retry.Status}}
+	for _, p := range policies {
+		if p.policy != nil && (p.policy.Attempts < -1 || p.policy.Backoff < 0) {
+			ces = append(ces, ConfigError{Path: p.path, Message: "Retry attempts must be -1 (none) or more, and backoff 0 or more"})
+		}
+	}
+
+	if c.Order != "" && c.Order != KOrderOldest && c.Order != KOrderNewest {
+		ces = append(ces, ConfigError{Path: "order", Message: fmt.Sprintf("Unknown order \"%v\" (oldest or newest)", c.Order)})
+	}
+
+	seen := map[string]int{}
+	for i, repo := range c.Repositories {
+		path := fmt.Sprintf("repositories[%v]", i)
+
+		sources := repo.SourceNames()
+		switch {
+		case len(sources) == 0:
+			ces = append(ces, ConfigError{Path: path, Message: "Missing repository source (one of github, bitbucket, forgejo or ssh)"})
+			continue
+
+		case len(sources) > 1:
+			ces = append(ces, ConfigError{Path: path + "." + sources[1], Message: fmt.Sprintf("Multiple repository sources (%v), only one is allowed", strings.Join(sources, ", "))})
+			continue
+
+		case repo.Source() == nil:
+			ces = append(ces, ConfigError{Path: path + "." + sources[0], Message: fmt.Sprintf("Incomplete %v block", sources[0])})
+			continue
+		}
+
+		if repo.Branch == "" {
+			ces = append(ces, ConfigError{Path: path, Message: "Missing branch"})
+			continue
+		}
+		if !ValidBranchName(repo.Branch) {
+			ces = append(ces, ConfigError{Path: path + ".branch", Message: fmt.Sprintf("Invalid branch name \"%v\"", repo.Branch)})
+			continue
+		}
+
+		if problems := repo.optionProblems(path); len(problems) > 0 {
+			ces = append(ces, problems...)
+			continue
+		}
+
+		id := repo.Identifier()
+		if j, fnd := seen[id]; fnd {
+			ces = append(ces, ConfigError{Path: path, Message: fmt.Sprintf("Duplicate of repositories[%v]", j)})
+			continue
+		}
+		seen[id] = i
+	}
+
+	for i, dc := range c.Discover {
+		where := fmt.Sprintf("discover[%v]", i)
+
+		sources := dc.Repository.SourceNames()
+		if dc.Gitlab != nil {
+			// an ssh block just holds the options for pulling from gitlab
+			if len(sources) == 1 && sources[0] == "ssh" {
+				sources = nil
+			}
+			sources = append(sources, "gitlab")
+		}
+
+		switch {
+		case len(sources) != 1 || sources[0] == "ssh":
+			ces = append(ces, ConfigError{Path: where, Message: "Discovery needs exactly one of repository.github, repository.bitbucket, repository.forgejo or gitlab"})
+
+		case dc.Gitlab != nil && (dc.Gitlab.Domain == "" || dc.Gitlab.Group == ""):
+			ces = append(ces, ConfigError{Path: where + ".gitlab", Message: "Discovery needs the gitlab domain and group"})
+
+		case dc.Repository.Github != nil && dc.Repository.Github.User == "":
+			ces = append(ces, ConfigError{Path: where + ".repository.github", Message: "Discovery needs the github user (or organisation)"})
+
+		case dc.Repository.Forgejo != nil && (dc.Repository.Forgejo.Domain == "" || dc.Repository.Forgejo.User == ""):
+			ces = append(ces, ConfigError{Path: where + ".repository.forgejo", Message: "Discovery needs the forgejo domain and user (or organisation)"})
+
+		case dc.Repository.Bitbucket != nil && dc.Repository.Bitbucket.Workspace == "":
+			ces = append(ces, ConfigError{Path: where + ".repository.bitbucket", Message: "Discovery needs the bitbucket workspace"})
+
+		case dc.Repository.Branch != "" && !ValidBranchName(dc.Repository.Branch):
+			ces = append(ces, ConfigError{Path: where + ".repository.branch", Message: fmt.Sprintf("Invalid branch name \"%v\"", dc.Repository.Branch)})
+		}
+
+		// the options discovered repositories get
+		ces = append(ces, dc.Repository.optionProblems(where+".repository")...)
+
+		for _, glob := range append(append([]string{}, dc.Include...), dc.Exclude...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				ces = append(ces, ConfigError{Path: where, Message: fmt.Sprintf("Bad glob \"%v\"", glob)})
+			}
+		}
+	}
+
+	return ces
+}
+
+// Problems with how a repository is tested, rather than where it is
+func (rc RepositoryConfiguration) optionProblems(path string) ConfigErrors {
+	ces := ConfigErrors{}
+
+	if rc.Backfill != nil && rc.Backfill.Count == 0 && rc.Backfill.Since == "" {
+		ces = append(ces, ConfigError{Path: path + ".backfill", Message: "Backfill needs a count or since"})
+	}
+
+	switch rc.Strategy {
+	case "", KStrategyAll, KStrategyTip, KStrategyFirstParent, KStrategyFirstParentAlias:
+	case KStrategyEvery:
+		if rc.Every < 2 {
+			ces = append(ces, ConfigError{Path: path + ".every", Message: "The every strategy needs every to be 2 or more"})
+		}
+	default:
+		ces = append(ces, ConfigError{Path: path + ".strategy", Message: fmt.Sprintf("Unknown strategy \"%v\" (one of all, tip, tip+first-parent or every)", rc.Strategy)})
+	}
+
+	switch rc.Runner {
+	case "", KRunnerLocal, KRunnerSystemd:
+	default:
+		ces = append(ces, ConfigError{Path: path + ".runner", Message: fmt.Sprintf("Unknown runner \"%v\" (local or systemd)", rc.Runner)})
+	}
+
+	return append(ces, rc.Systemd.Problems(path+".systemd")...)
+}
@@ -0,0 +1,61 @@
+/*
+validate_test.go - Tests of configuration validation
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func problemPaths(c Configuration) string {
+	paths := []string{}
+	for _, ce := range c.Problems() {
+		paths = append(paths, ce.Path)
+	}
+	return strings.Join(paths, " ")
+}
+
+func TestDiscoveredRepositoryOptionsValidated(t *testing.T) {
+	c := Configuration{
+		Var: "/var/lib/cix",
+		Discover: []DiscoveryConfiguration{{
+			Repository: RepositoryConfiguration{
+				Github:   &GithubConfiguration{User: "owner"},
+				Strategy: KStrategyEvery,
+				Runner:   "docker",
+			},
+		}},
+	}
+
+	expected := "discover[0].repository.every discover[0].repository.runner"
+	if paths := problemPaths(c); paths != expected {
+		t.Fatalf("problems at %v, expected %v", paths, expected)
+	}
+}
+
+func TestFirstParentStrategyNames(t *testing.T) {
+	for _, name := range []string{KStrategyFirstParent, KStrategyFirstParentAlias} {
+		rc := RepositoryConfiguration{
+			Github:   &GithubConfiguration{User: "owner", Repository: "repo"},
+			Branch:   "main",
+			Strategy: name,
+		}
+		c := Configuration{Var: "/var/lib/cix", Repositories: []RepositoryConfiguration{rc}}
+
+		if paths := problemPaths(c); paths != "" {
+			t.Errorf("%v has problems at %v", name, paths)
+		}
+		if rc.ResolvedStrategy() != KStrategyFirstParent {
+			t.Errorf("%v resolved to %v", name, rc.ResolvedStrategy())
+		}
+	}
+}
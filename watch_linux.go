@@ -0,0 +1,154 @@
+//go:build linux
+
+/*
+watch_linux.go - Watching the configuration with inotify
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Watches files for changes
+type Watcher struct {
+	file *os.File
+}
+
+// Watch files, sending on changed (without blocking) when any of them change
+// The directories are watched rather than the files, as editors and NixOS replace files rather than write them
+// and so are the symlinks leading to the files, as NixOS switches configuration by replacing a link
+func WatchFiles(files []string, changed chan<- struct{}) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start inotify: %v", err)
+	}
+	// non blocking, so reads go through the poller and Close interrupts them
+	w := &Watcher{file: os.NewFile(uintptr(fd), "inotify")}
+
+	names := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+
+		for _, path := range linkChain(abs) {
+			if strings.HasPrefix(path, "/nix/store/") {
+				// store paths never change, only the links to them
+				continue
+			}
+			names[path] = true
+			dirs[filepath.Dir(path)] = true
+		}
+	}
+
+	wds := map[int32]string{}
+	for dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("Failed to watch %v: %v", dir, err)
+		}
+		wds[int32(wd)] = dir
+	}
+
+	go w.run(names, wds, changed)
+	return w, nil
+}
+
+// The paths whose replacement changes what a file is, the file and every symlink met resolving it
+// On NixOS /etc/cix/config.json -> /etc/static/cix/config.json, and /etc/static -> /nix/store/...-etc/etc is what changes
+func linkChain(file string) []string {
+	chain := []string{file}
+
+	pending := file
+	for hops := 0; hops < 40; hops++ {
+		link, rest := firstLink(pending)
+		if link == "" {
+			break
+		}
+
+		target, err := os.Readlink(link)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(link), target)
+		}
+
+		pending = filepath.Join(target, rest)
+		chain = append(chain, link, pending)
+	}
+	return chain
+}
+
+// The first symlink on an absolute path, and the rest of the path after it ("" if there are none)
+func firstLink(path string) (string, string) {
+	parts := strings.Split(strings.TrimPrefix(filepath.Clean(path), "/"), "/")
+	prefix := "/"
+	for i, part := range parts {
+		prefix = filepath.Join(prefix, part)
+		fi, err := os.Lstat(prefix)
+		if err != nil {
+			return "", ""
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return prefix, filepath.Join(parts[i+1:]...)
+		}
+	}
+	return "", ""
+}
+
+func (w *Watcher) run(names map[string]bool, wds map[int32]string, changed chan<- struct{}) {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil {
+			// closed
+			return
+		}
+
+		hit := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if names[filepath.Join(wds[event.Wd], name)] {
+				hit = true
+			}
+		}
+
+		if hit {
+			// let a burst of writes settle before reporting
+			time.Sleep(250 * time.Millisecond)
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
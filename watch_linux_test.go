@@ -0,0 +1,54 @@
+//go:build linux
+
+/*
+watch_linux_test.go - Tests of the inotify watcher
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// As NixOS does it, /etc/cix/config.json -> /etc/static/cix/config.json and /etc/static -> /nix/store/...-etc/etc
+func TestWatchFollowsReplacedLinks(t *testing.T) {
+	dir := t.TempDir()
+	for _, generation := range []string{"one", "two"} {
+		os.MkdirAll(filepath.Join(dir, "store", generation, "cix"), 0777)
+		os.WriteFile(filepath.Join(dir, "store", generation, "cix", "config.json"), []byte(generation), 0666)
+	}
+
+	etc := filepath.Join(dir, "etc")
+	os.MkdirAll(filepath.Join(etc, "cix"), 0777)
+	os.Symlink(filepath.Join(dir, "store", "one"), filepath.Join(etc, "static"))
+	os.Symlink("../static/cix/config.json", filepath.Join(etc, "cix", "config.json"))
+
+	changed := make(chan struct{}, 1)
+	w, err := WatchFiles([]string{filepath.Join(etc, "cix", "config.json")}, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// switch generation by atomically replacing the link further up the chain
+	os.Symlink(filepath.Join(dir, "store", "two"), filepath.Join(etc, "static.tmp"))
+	if err := os.Rename(filepath.Join(etc, "static.tmp"), filepath.Join(etc, "static")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no change seen when the link was replaced")
+	}
+}
@@ -0,0 +1,84 @@
+//go:build !linux
+
+/*
+watch_other.go - Watching the configuration without inotify
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Watches files for changes
+type Watcher struct {
+	done chan struct{}
+}
+
+// A file's modification time and where its symlinks lead
+// Both are needed as NixOS switches configuration by replacing links, and store paths all have the same time
+type fileVersion struct {
+	ModTime  time.Time
+	Resolved string
+}
+
+func modTimes(files []string) map[string]fileVersion {
+	times := map[string]fileVersion{}
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			resolved, _ := filepath.EvalSymlinks(file)
+			times[file] = fileVersion{ModTime: fi.ModTime(), Resolved: resolved}
+		}
+	}
+	return times
+}
+
+// Watch files, sending on changed (without blocking) when any of them change
+// Without inotify we poll the modification times
+func WatchFiles(files []string, changed chan<- struct{}) (*Watcher, error) {
+	w := &Watcher{done: make(chan struct{})}
+
+	go func() {
+		before := modTimes(files)
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-time.After(5 * time.Second):
+			}
+
+			after := modTimes(files)
+			different := len(after) != len(before)
+			for file, v := range after {
+				if !before[file].ModTime.Equal(v.ModTime) || before[file].Resolved != v.Resolved {
+					different = true
+				}
+			}
+			before = after
+
+			if different {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *Watcher) Close() error {
+	close(w.done)
+	return nil
+}
@@ -0,0 +1,343 @@
+/*
+yaml.go - A minimal yaml reader for Cix configuration
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+// Cix has no dependencies, so rather than pull in a yaml library this reads the subset of yaml
+// a configuration needs: block mappings and sequences, single line flow sequences of scalars, plain
+// and quoted scalars and comments. Anchors, tags, flow mappings, block scalars and multiple
+// documents are rejected, rather than read differently to a full yaml parser.
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type yamlLine struct {
+	// 1 based line in the file
+	Number int
+
+	Indent  int
+	Content string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	next  int
+}
+
+// Something yaml this can't read, and where
+type yamlError struct {
+	// 1 based
+	Line, Column int
+
+	Message string
+}
+
+func (ye *yamlError) Error() string {
+	return fmt.Sprintf("yaml line %v: %v", ye.Line, ye.Message)
+}
+
+// An error at the start of a line's content
+func yamlErrorf(line yamlLine, format string, args ...interface{}) error {
+	return &yamlError{Line: line.Number, Column: line.Indent + 1, Message: fmt.Sprintf(format, args...)}
+}
+
+// Remove a trailing comment, respecting quotes
+func stripYamlComment(s string) string {
+	quote := rune(0)
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+
+		case r == '"' || r == '\'':
+			quote = r
+
+		case r == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return strings.TrimRight(s[:i], " \t")
+		}
+	}
+	return strings.TrimRight(s, " \t")
+}
+
+func splitYamlLines(blob string) ([]yamlLine, error) {
+	lines := []yamlLine{}
+	for i, raw := range strings.Split(blob, "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		content := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(content, "\t") {
+			return nil, &yamlError{Line: i + 1, Column: len(raw) - len(content) + 1, Message: "tabs are not allowed for indentation"}
+		}
+
+		content = stripYamlComment(content)
+		if content == "" {
+			continue
+		}
+		if content == "---" && len(lines) == 0 {
+			continue
+		}
+		if content == "---" || content == "..." {
+			return nil, &yamlError{Line: i + 1, Column: 1, Message: "multiple documents are not supported"}
+		}
+
+		lines = append(lines, yamlLine{Number: i + 1, Indent: len(raw) - len(strings.TrimLeft(raw, " ")), Content: content})
+	}
+	return lines, nil
+}
+
+// A "key: value" line, key may be quoted
+var yamlKeyRe = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|'(?:[^']|'')*'|[^"'\[\]{}#,&*!|>%@` + "`" + `][^:#]*?)\s*:(?:\s+(.*))?$`)
+
+func isYamlSequence(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+func (yp *yamlParser) parseNode(indent int) (interface{}, error) {
+	line := yp.lines[yp.next]
+	if isYamlSequence(line.Content) {
+		return yp.parseSequence(line.Indent)
+	}
+	if yamlKeyRe.MatchString(line.Content) {
+		return yp.parseMapping(line.Indent)
+	}
+
+	yp.next += 1
+	return parseYamlScalar(line, line.Content)
+}
+
+// The value following a "key:" or "-" with nothing after it
+func (yp *yamlParser) parseChild(parent yamlLine, allowSequence bool) (interface{}, error) {
+	if yp.next == len(yp.lines) {
+		return nil, nil
+	}
+
+	line := yp.lines[yp.next]
+	if line.Indent > parent.Indent {
+		return yp.parseNode(line.Indent)
+	}
+
+	// yaml allows a sequence at the same indent as its key
+	if allowSequence && line.Indent == parent.Indent && isYamlSequence(line.Content) {
+		return yp.parseSequence(line.Indent)
+	}
+	return nil, nil
+}
+
+func (yp *yamlParser) parseSequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for yp.next < len(yp.lines) {
+		line := yp.lines[yp.next]
+		if line.Indent < indent {
+			break
+		}
+		if line.Indent > indent {
+			return nil, yamlErrorf(line, "unexpected indentation")
+		}
+		if !isYamlSequence(line.Content) {
+			break
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(line.Content, "-"), " ")
+		if rest == "" {
+			yp.next += 1
+			item, err := yp.parseChild(line, false)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, item)
+			continue
+		}
+
+		// treat "- key: value" as if the item started on its own line
+		yp.lines[yp.next] = yamlLine{
+			Number:  line.Number,
+			Indent:  line.Indent + len(line.Content) - len(rest),
+			Content: rest,
+		}
+		item, err := yp.parseNode(yp.lines[yp.next].Indent)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, item)
+	}
+	return seq, nil
+}
+
+func (yp *yamlParser) parseMapping(indent int) (interface{}, error) {
+	mapping := map[string]interface{}{}
+	for yp.next < len(yp.lines) {
+		line := yp.lines[yp.next]
+		if line.Indent < indent {
+			break
+		}
+		if line.Indent > indent {
+			return nil, yamlErrorf(line, "unexpected indentation")
+		}
+
+		m := yamlKeyRe.FindStringSubmatch(line.Content)
+		if m == nil {
+			if isYamlSequence(line.Content) {
+				break
+			}
+			return nil, yamlErrorf(line, "expected \"key: value\"")
+		}
+
+		key, err := parseYamlScalar(line, m[1])
+		if err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("%v", key)
+		if _, fnd := mapping[name]; fnd {
+			return nil, yamlErrorf(line, "duplicate key \"%v\"", name)
+		}
+
+		yp.next += 1
+		if m[2] == "" {
+			mapping[name], err = yp.parseChild(line, true)
+		} else {
+			mapping[name], err = parseYamlScalar(line, m[2])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mapping, nil
+}
+
+// A block scalar header, e.g. "|", ">-" or "|+2"
+var yamlBlockScalarRe = regexp.MustCompile(`^[|>][-+0-9]*$`)
+
+var yamlNumberRe = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// A scalar, or a single line flow sequence
+func parseYamlScalar(line yamlLine, s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "["):
+		return parseYamlFlowSequence(line, s)
+
+	case strings.HasPrefix(s, "{"):
+		return nil, yamlErrorf(line, "flow mappings are not supported, use a block mapping")
+
+	case strings.HasPrefix(s, "\""):
+		var str string
+		if err := json.Unmarshal([]byte(s), &str); err != nil {
+			return nil, yamlErrorf(line, "bad quoted string %v", s)
+		}
+		return str, nil
+
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, yamlErrorf(line, "bad quoted string %v", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+
+	case yamlBlockScalarRe.MatchString(s):
+		return nil, yamlErrorf(line, "block scalars are not supported")
+
+	case strings.HasPrefix(s, "&") || strings.HasPrefix(s, "*") || strings.HasPrefix(s, "!"):
+		return nil, yamlErrorf(line, "anchors, aliases and tags are not supported")
+
+	case s == "" || s == "~" || s == "null":
+		return nil, nil
+
+	case s == "true":
+		return true, nil
+
+	case s == "false":
+		return false, nil
+
+	case yamlNumberRe.MatchString(s):
+		return json.Number(s), nil
+	}
+
+	return s, nil
+}
+
+// A flow sequence of scalars on one line, e.g. [a.json, "b c.json"]
+func parseYamlFlowSequence(line yamlLine, s string) (interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, yamlErrorf(line, "flow sequences must end with ] on the same line")
+	}
+
+	// split on the commas outside quotes
+	items := []string{}
+	start, quote, escaped := 1, rune(0), false
+	for i, r := range s[:len(s)-1] {
+		switch {
+		case i == 0:
+
+		case escaped:
+			escaped = false
+
+		case quote == '"' && r == '\\':
+			escaped = true
+
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+
+		case r == '"' || r == '\'':
+			quote = r
+
+		case r == '[' || r == ']' || r == '{' || r == '}':
+			return nil, yamlErrorf(line, "only flow sequences of scalars are supported")
+
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start : len(s)-1]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+
+	seq := []interface{}{}
+	for _, item := range items {
+		if strings.TrimSpace(item) == "" {
+			return nil, yamlErrorf(line, "empty item in flow sequence")
+		}
+		v, err := parseYamlScalar(line, item)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+// Convert a yaml document to json
+func YamlToJson(blob []byte) ([]byte, error) {
+	lines, err := splitYamlLines(string(blob))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return []byte("null"), nil
+	}
+
+	yp := yamlParser{lines: lines}
+	v, err := yp.parseNode(lines[0].Indent)
+	if err != nil {
+		return nil, err
+	}
+	if yp.next != len(yp.lines) {
+		return nil, yamlErrorf(yp.lines[yp.next], "unexpected indentation")
+	}
+
+	return json.MarshalIndent(v, "", "    ")
+}
@@ -0,0 +1,139 @@
+/*
+yaml_test.go - Tests of the yaml subset
+
+# Copyright 2024 Duncan Steele
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the “Software”), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYamlToJson(t *testing.T) {
+	cases := []struct {
+		name string
+		yaml string
+		json string
+	}{
+		{"empty", "", `null`},
+		{"comment only", "# nothing here\n", `null`},
+		{"document start", "---\nvar: /var/lib/cix\n", `{"var": "/var/lib/cix"}`},
+
+		{"block mapping", "var: /var/lib/cix\npollinginterval: 60\nverbose: true\n",
+			`{"var": "/var/lib/cix", "pollinginterval": 60, "verbose": true}`},
+		{"nested mapping", "github:\n  user: owner\n  repository: repo\n",
+			`{"github": {"user": "owner", "repository": "repo"}}`},
+		{"block sequence", "- one\n- two\n", `["one", "two"]`},
+		{"sequence of mappings", "repositories:\n  - branch: main\n    github:\n      user: owner\n  - branch: dev\n",
+			`{"repositories": [{"branch": "main", "github": {"user": "owner"}}, {"branch": "dev"}]}`},
+		{"sequence at the key's indent", "include:\n- a.json\n- b.json\n", `{"include": ["a.json", "b.json"]}`},
+		{"nested sequences", "-\n  - 1\n  - 2\n- - 3\n", `[[1, 2], [3]]`},
+		{"empty value", "template:\nbranch: main\n", `{"template": null, "branch": "main"}`},
+
+		{"flow sequence", "include: [a.json, 'b c.json', \"d\"]\n", `{"include": ["a.json", "b c.json", "d"]}`},
+		{"flow sequence quoting", `a: ["x, y", 'it''s [1]', "\"q\""]`, `{"a": ["x, y", "it's [1]", "\"q\""]}`},
+		{"flow sequence of scalars", "a: [1, true, ~]\n", `{"a": [1, true, null]}`},
+		{"empty flow", "a: []\n", `{"a": []}`},
+
+		{"double quoted", `name: "a \"quoted\" # not a comment\n"`, `{"name": "a \"quoted\" # not a comment\n"}`},
+		{"single quoted", `name: 'it''s # here'`, `{"name": "it's # here"}`},
+		{"quoted key", `"a key": 1`, `{"a key": 1}`},
+		{"quoted scalars stay strings", "a: \"true\"\nb: '12'\n", `{"a": "true", "b": "12"}`},
+		{"plain with colon", "url: https://example.com/x\n", `{"url": "https://example.com/x"}`},
+		{"plain with hash", "name: c#sharp\n", `{"name": "c#sharp"}`},
+
+		{"null", "a: ~\nb: null\n", `{"a": null, "b": null}`},
+		{"numbers", "a: 0\nb: -12\nc: 1.5\nd: 1e3\ne: 012\n", `{"a": 0, "b": -12, "c": 1.5, "d": 1e3, "e": "012"}`},
+
+		{"comments", "# top\nvar: x # trailing\n\n  # indented\nname: y\n", `{"var": "x", "name": "y"}`},
+		{"windows line endings", "a: 1\r\nb: 2\r\n", `{"a": 1, "b": 2}`},
+	}
+
+	for _, tc := range cases {
+		blob, err := YamlToJson([]byte(tc.yaml))
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+
+		var got, expected interface{}
+		if err := json.Unmarshal(blob, &got); err != nil {
+			t.Errorf("%v: bad json %s", tc.name, blob)
+			continue
+		}
+		json.Unmarshal([]byte(tc.json), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%v: got %s, expected %v", tc.name, blob, tc.json)
+		}
+	}
+}
+
+func TestYamlErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		yaml  string
+		error string
+	}{
+		{"tab indent", "a:\n\tb: 1\n", "yaml line 2: tabs"},
+		{"bad indent", "a: 1\n  b: 2\n", "yaml line 2: unexpected indentation"},
+		{"multi line plain scalar", "a: one\n  two\n", "yaml line 2: unexpected indentation"},
+		{"multi line flow", "a: [1,\n  2]\n", "yaml line 1: flow sequences must end"},
+		{"duplicate key", "a: 1\n\nb: 2\na: 3\n", "yaml line 4: duplicate key \"a\""},
+		{"not a mapping", "a: 1\njust text\n", "yaml line 2: expected \"key: value\""},
+		{"literal block", "a: |\n  text\n", "yaml line 1: block scalars"},
+		{"folded block", "a: >-\n  text\n", "yaml line 1: block scalars"},
+		{"kept block", "a: |+\n  text\n", "yaml line 1: block scalars"},
+		{"indented block", "a: >2\n  text\n", "yaml line 1: block scalars"},
+		{"anchor", "a: &base\n  b: 1\n", "yaml line 1: anchors"},
+		{"alias", "a: 1\nb: *base\n", "yaml line 2: anchors"},
+		{"tag", "a: !!str 1\n", "yaml line 1: anchors, aliases and tags"},
+		{"documents", "a: 1\n---\nb: 2\n", "yaml line 2: multiple documents"},
+		{"unterminated quote", "a: \"open\n", "yaml line 1: bad quoted string"},
+		{"unterminated flow", "a: [1, 2\n", "yaml line 1: flow sequences must end"},
+		{"trailing after flow", "a: [1] x\n", "yaml line 1: flow sequences must end"},
+		{"flow mapping", "github: {user: owner}\n", "yaml line 1: flow mappings are not supported"},
+		{"flow mapping item", "- {a: 1}\n", "yaml line 1: flow mappings are not supported"},
+		{"nested flow", "a: [[1], 2]\n", "yaml line 1: only flow sequences of scalars"},
+		{"mapping in flow", "a: [{b: 1}]\n", "yaml line 1: only flow sequences of scalars"},
+		{"empty flow item", "a: [1, , 2]\n", "yaml line 1: empty item"},
+		{"document end", "a: 1\n...\n", "yaml line 2: multiple documents"},
+	}
+
+	for _, tc := range cases {
+		_, err := YamlToJson([]byte(tc.yaml))
+		if err == nil {
+			t.Errorf("%v: no error", tc.name)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tc.error) {
+			t.Errorf("%v: error %q, expected %q", tc.name, err, tc.error)
+		}
+	}
+}
+
+// Errors in a yaml configuration point at the line (and indent) they are on
+func TestYamlConfigurationErrorPosition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cix.yaml")
+	os.WriteFile(path, []byte("var: /var/lib/cix\nrepositories:\n  - branch: main\n    github: {user: owner}\n"), 0666)
+
+	_, err := LoadConfiguration(path)
+	var ces ConfigErrors
+	if !errors.As(err, &ces) || len(ces) != 1 {
+		t.Fatalf("expected one configuration error, got %v", err)
+	}
+	if ce := ces[0]; ce.File != path || ce.Line != 4 || ce.Column != 5 {
+		t.Errorf("error at %v:%v:%v, expected line 4 column 5: %v", ce.File, ce.Line, ce.Column, ce)
+	}
+}